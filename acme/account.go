@@ -3,27 +3,53 @@ package acme
 import (
 	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
+	legoacme "github.com/go-acme/lego/v3/acme"
 	"github.com/go-acme/lego/v3/lego"
 	"github.com/go-acme/lego/v3/registration"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
 type account struct {
-	Email                 string
-	Registration          *registration.Resource
-	Key                   crypto.PrivateKey
-	KeyType               string
-	ServerURL             string
-	Provider              string
-	ProviderConfiguration map[string]string
-	EnableHTTP01          bool
-	EnableTLSALPN01       bool
-	TermsOfServiceAgreed  bool
-	DNSResolvers          []string
-	IgnoreDNSPropagation  bool
+	Email                      string
+	Registration               *registration.Resource
+	Key                        crypto.PrivateKey
+	KeyType                    string
+	ServerURL                  string
+	ServerURLAlias             string
+	Provider                   string
+	ProviderConfiguration      map[string]string
+	DNSProvider                string
+	DNSZoneProviders           map[string]string
+	EnableHTTP01               bool
+	EnableTLSALPN01            bool
+	TermsOfServiceAgreed       bool
+	TermsOfServiceURL          string
+	DNSResolvers               []string
+	PropagationTimeout         int
+	PollingInterval            int
+	TXTTTL                     int
+	IgnoreDNSPropagation       bool
+	EABKeyID                   string
+	CABundle                   string
+	HTTPProxy                  string
+	HTTPTimeout                int
+	UserAgent                  string
+	CertificatesPerDomainLimit int
+	FailedValidationsLimit     int
+	RateLimitAction            string
+	ChallengePreference        []string
 }
 
 // GetEmail returns the Email of the user
@@ -41,84 +67,229 @@ func (a *account) GetPrivateKey() crypto.PrivateKey {
 	return a.Key
 }
 
-func (a *account) getClient() (*lego.Client, error) {
+func (a *account) getConfig() (*lego.Config, error) {
 	config := lego.NewConfig(a)
 	config.CADirURL = a.ServerURL
+	config.UserAgent = a.UserAgent
 
-	return lego.NewClient(config)
+	if a.HTTPTimeout > 0 {
+		config.HTTPClient.Timeout = time.Duration(a.HTTPTimeout) * time.Second
+	}
+
+	if a.CABundle == "" && a.HTTPProxy == "" {
+		return config, nil
+	}
+
+	// We start from the transport created by lego so we keep its defaults
+	transport := config.HTTPClient.Transport.(*http.Transport).Clone()
+	if a.CABundle != "" {
+		pool, err := getCertPool(a.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	if a.HTTPProxy != "" {
+		proxy, err := url.Parse(a.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse http_proxy: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	config.HTTPClient.Transport = transport
+
+	return config, nil
 }
 
-func getAccount(ctx context.Context, storage logical.Storage, path string) (*account, error) {
-	storageEntry, err := storage.Get(ctx, path)
+func (a *account) getClient() (*lego.Client, error) {
+	config, err := a.getConfig()
 	if err != nil {
 		return nil, err
 	}
-	if storageEntry == nil {
-		return nil, nil
+	return lego.NewClient(config)
+}
+
+// getCertPool returns a pool with the system certificates and the ones in
+// bundle
+func getCertPool(bundle string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM([]byte(bundle)) {
+		return nil, errors.New("failed to parse ca_bundle")
 	}
-	var d map[string]interface{}
-	if err = storageEntry.DecodeJSON(&d); err != nil {
+	return pool, nil
+}
+
+// accountKeyPrefix is where the private keys of the accounts are stored, apart
+// from their settings so they can be seal wrapped
+const accountKeyPrefix = "account_keys/"
+
+// accountKeyPath returns the path of the private key of the account at path
+func accountKeyPath(path string) string {
+	return accountKeyPrefix + strings.TrimPrefix(path, "accounts/")
+}
+
+type accountKeyEntry struct {
+	PrivateKey string `json:"private_key"`
+}
+
+// accountEntry is the layout of the accounts in the storage
+type accountEntry struct {
+	SchemaVersion              int               `json:"schema_version"`
+	ServerURL                  string            `json:"server_url"`
+	ServerURLAlias             string            `json:"server_url_alias"`
+	RegistrationURI            string            `json:"registration_uri"`
+	Registration               *legoacme.Account `json:"registration,omitempty"`
+	Contact                    string            `json:"contact"`
+	TermsOfServiceAgreed       bool              `json:"terms_of_service_agreed"`
+	TermsOfServiceURL          string            `json:"terms_of_service_url"`
+	PrivateKey                 string            `json:"private_key,omitempty"`
+	KeyType                    string            `json:"key_type"`
+	Provider                   string            `json:"provider"`
+	ProviderConfiguration      map[string]string `json:"provider_configuration"`
+	DNSProvider                string            `json:"dns_provider"`
+	DNSZoneProviders           map[string]string `json:"dns_zone_providers"`
+	EnableHTTP01               bool              `json:"enable_http_01"`
+	EnableTLSALPN01            bool              `json:"enable_tls_alpn_01"`
+	DNSResolvers               []string          `json:"dns_resolvers"`
+	PropagationTimeout         int               `json:"propagation_timeout"`
+	PollingInterval            int               `json:"polling_interval"`
+	TXTTTL                     int               `json:"txt_ttl"`
+	IgnoreDNSPropagation       bool              `json:"ignore_dns_propagation"`
+	EABKeyID                   string            `json:"eab_kid"`
+	CABundle                   string            `json:"ca_bundle"`
+	HTTPProxy                  string            `json:"http_proxy"`
+	HTTPTimeout                int               `json:"http_timeout"`
+	UserAgent                  string            `json:"user_agent"`
+	CertificatesPerDomainLimit int               `json:"certificates_per_domain_limit"`
+	FailedValidationsLimit     int               `json:"failed_validations_limit"`
+	RateLimitAction            string            `json:"rate_limit_action"`
+	ChallengePreference        []string          `json:"challenge_preference"`
+}
+
+func getAccount(ctx context.Context, storage logical.Storage, path string) (*account, error) {
+	var e accountEntry
+	found, err := accountSchema.decode(ctx, storage, path, &e)
+	if err != nil || !found {
 		return nil, err
 	}
 
-	block, _ := pem.Decode([]byte(d["private_key"].(string)))
+	// The key was stored with the other settings before version 2
+	keyPEM := e.PrivateKey
+	if keyPEM == "" {
+		keyEntry, err := storage.Get(ctx, accountKeyPath(path))
+		if err != nil {
+			return nil, err
+		}
+		if keyEntry == nil {
+			return nil, fmt.Errorf("the private key of %q is missing", path)
+		}
+		var k accountKeyEntry
+		if err = keyEntry.DecodeJSON(&k); err != nil {
+			return nil, err
+		}
+		keyPEM = k.PrivateKey
+	}
+
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode the private key of %q", path)
+	}
 	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
 	if err != nil {
 		return nil, err
 	}
 
-	providerConfiguration := map[string]string{}
-	for k, v := range d["provider_configuration"].(map[string]interface{}) {
-		providerConfiguration[k] = v.(string)
-	}
-
 	a := &account{
-		Email:   d["contact"].(string),
+		Email:   e.Contact,
 		Key:     privateKey,
-		KeyType: d["key_type"].(string),
+		KeyType: e.KeyType,
 		Registration: &registration.Resource{
-			URI: d["registration_uri"].(string),
+			URI: e.RegistrationURI,
 		},
-		ServerURL:             d["server_url"].(string),
-		Provider:              d["provider"].(string),
-		ProviderConfiguration: providerConfiguration,
-		TermsOfServiceAgreed:  d["terms_of_service_agreed"].(bool),
-		EnableHTTP01:          d["enable_http_01"].(bool),
-		EnableTLSALPN01:       d["enable_tls_alpn_01"].(bool),
+		ServerURL:                  e.ServerURL,
+		ServerURLAlias:             e.ServerURLAlias,
+		Provider:                   e.Provider,
+		ProviderConfiguration:      e.ProviderConfiguration,
+		DNSProvider:                e.DNSProvider,
+		DNSZoneProviders:           e.DNSZoneProviders,
+		TermsOfServiceAgreed:       e.TermsOfServiceAgreed,
+		TermsOfServiceURL:          e.TermsOfServiceURL,
+		EnableHTTP01:               e.EnableHTTP01,
+		EnableTLSALPN01:            e.EnableTLSALPN01,
+		DNSResolvers:               e.DNSResolvers,
+		PropagationTimeout:         e.PropagationTimeout,
+		PollingInterval:            e.PollingInterval,
+		TXTTTL:                     e.TXTTTL,
+		IgnoreDNSPropagation:       e.IgnoreDNSPropagation,
+		EABKeyID:                   e.EABKeyID,
+		CABundle:                   e.CABundle,
+		HTTPProxy:                  e.HTTPProxy,
+		HTTPTimeout:                e.HTTPTimeout,
+		UserAgent:                  e.UserAgent,
+		CertificatesPerDomainLimit: e.CertificatesPerDomainLimit,
+		FailedValidationsLimit:     e.FailedValidationsLimit,
+		RateLimitAction:            e.RateLimitAction,
+		ChallengePreference:        e.ChallengePreference,
 	}
 
-	if ignoreDNSPropagation, ok := d["ignore_dns_propagation"]; ok {
-		a.IgnoreDNSPropagation = ignoreDNSPropagation.(bool)
-	}
-
-	a.DNSResolvers = make([]string, len(d["dns_resolvers"].([]interface{})))
-	for i, resolver := range d["dns_resolvers"].([]interface{}) {
-		a.DNSResolvers[i] = resolver.(string)
+	// Older entries only have the registration URI
+	if e.Registration != nil {
+		a.Registration.Body = *e.Registration
 	}
 
 	return a, nil
 }
 
 func (a *account) save(ctx context.Context, storage logical.Storage, path string, serverURL string) error {
-	x509Encoded, err := x509.MarshalPKCS8PrivateKey(a.Key)
+	pemEncoded, err := encodePrivateKey(a.Key)
 	if err != nil {
 		return err
 	}
-	pemEncoded := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: x509Encoded})
-
-	storageEntry, err := logical.StorageEntryJSON(path, map[string]interface{}{
-		"server_url":              serverURL,
-		"registration_uri":        a.Registration.URI,
-		"contact":                 a.GetEmail(),
-		"terms_of_service_agreed": a.TermsOfServiceAgreed,
-		"private_key":             string(pemEncoded),
-		"key_type":                a.KeyType,
-		"provider":                a.Provider,
-		"provider_configuration":  a.ProviderConfiguration,
-		"enable_http_01":          a.EnableHTTP01,
-		"enable_tls_alpn_01":      a.EnableTLSALPN01,
-		"dns_resolvers":           a.DNSResolvers,
-		"ignore_dns_propagation":  a.IgnoreDNSPropagation,
+
+	// The key must be written first so the account is never missing its key
+	keyEntry, err := logical.StorageEntryJSON(accountKeyPath(path), &accountKeyEntry{
+		PrivateKey: pemEncoded,
+	})
+	if err != nil {
+		return err
+	}
+	if err = storage.Put(ctx, keyEntry); err != nil {
+		return err
+	}
+
+	storageEntry, err := logical.StorageEntryJSON(path, &accountEntry{
+		SchemaVersion:              accountSchema.version(),
+		ServerURL:                  serverURL,
+		ServerURLAlias:             a.ServerURLAlias,
+		RegistrationURI:            a.Registration.URI,
+		Registration:               &a.Registration.Body,
+		Contact:                    a.GetEmail(),
+		TermsOfServiceAgreed:       a.TermsOfServiceAgreed,
+		TermsOfServiceURL:          a.TermsOfServiceURL,
+		KeyType:                    a.KeyType,
+		Provider:                   a.Provider,
+		ProviderConfiguration:      a.ProviderConfiguration,
+		DNSProvider:                a.DNSProvider,
+		DNSZoneProviders:           a.DNSZoneProviders,
+		EnableHTTP01:               a.EnableHTTP01,
+		EnableTLSALPN01:            a.EnableTLSALPN01,
+		DNSResolvers:               a.DNSResolvers,
+		PropagationTimeout:         a.PropagationTimeout,
+		PollingInterval:            a.PollingInterval,
+		TXTTTL:                     a.TXTTTL,
+		IgnoreDNSPropagation:       a.IgnoreDNSPropagation,
+		EABKeyID:                   a.EABKeyID,
+		CABundle:                   a.CABundle,
+		HTTPProxy:                  a.HTTPProxy,
+		HTTPTimeout:                a.HTTPTimeout,
+		UserAgent:                  a.UserAgent,
+		CertificatesPerDomainLimit: a.CertificatesPerDomainLimit,
+		FailedValidationsLimit:     a.FailedValidationsLimit,
+		RateLimitAction:            a.RateLimitAction,
+		ChallengePreference:        a.ChallengePreference,
 	})
 	if err != nil {
 		return err
@@ -126,3 +297,55 @@ func (a *account) save(ctx context.Context, storage logical.Storage, path string
 
 	return storage.Put(ctx, storageEntry)
 }
+
+// encodePrivateKey returns the key PEM encoded in the PKCS#8 format
+func encodePrivateKey(key crypto.PrivateKey) (string, error) {
+	x509Encoded, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: x509Encoded})), nil
+}
+
+// parsePrivateKey decodes a PEM encoded private key in the PKCS#1, PKCS#8 or
+// SEC1 format
+func parsePrivateKey(data string) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
+
+// getKeyTypeName returns the key type of key as used in the key_type field
+func getKeyTypeName(key crypto.PrivateKey) (string, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return "EC256", nil
+		case elliptic.P384():
+			return "EC384", nil
+		}
+	case *rsa.PrivateKey:
+		switch k.N.BitLen() {
+		case 2048:
+			return "RSA2048", nil
+		case 4096:
+			return "RSA4096", nil
+		case 8192:
+			return "RSA8192", nil
+		}
+	}
+	return "", errors.New("unsupported private key type")
+}
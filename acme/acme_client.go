@@ -0,0 +1,230 @@
+package acme
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+
+	legoacme "github.com/go-acme/lego/v3/acme"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// acmeClient talks directly to the ACME server for the few operations that
+// are not supported by lego.
+type acmeClient struct {
+	httpClient *http.Client
+	userAgent  string
+	directory  directory
+	nonces     []string
+}
+
+// directory is the ACME directory object, lego does not know about all the
+// fields of its meta object
+type directory struct {
+	legoacme.Directory
+	Meta directoryMeta `json:"meta"`
+}
+
+type directoryMeta struct {
+	legoacme.Meta
+	Profiles map[string]string `json:"profiles"`
+}
+
+// userAgentProduct is added after user_agent in the User-Agent of the requests
+// sent directly to the ACME server, the same way lego adds its own
+const userAgentProduct = "vault-acme"
+
+func formatUserAgent(userAgent string) string {
+	return strings.TrimSpace(fmt.Sprintf("%s %s (%s; %s)", userAgent, userAgentProduct, runtime.GOOS, runtime.GOARCH))
+}
+
+func newACMEClient(a *account) (*acmeClient, error) {
+	config, err := a.getConfig()
+	if err != nil {
+		return nil, err
+	}
+	c := &acmeClient{
+		httpClient: config.HTTPClient,
+		userAgent:  formatUserAgent(config.UserAgent),
+	}
+
+	resp, err := c.do(http.MethodGet, a.ServerURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get directory: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get directory: unexpected status %d", resp.StatusCode)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&c.directory); err != nil {
+		return nil, fmt.Errorf("failed to decode directory: %v", err)
+	}
+
+	return c, nil
+}
+
+func (c *acmeClient) do(method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/jose+json")
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	return c.httpClient.Do(req)
+}
+
+// Nonce implements jose.NonceSource
+func (c *acmeClient) Nonce() (string, error) {
+	if len(c.nonces) > 0 {
+		nonce := c.nonces[len(c.nonces)-1]
+		c.nonces = c.nonces[:len(c.nonces)-1]
+		return nonce, nil
+	}
+
+	resp, err := c.do(http.MethodHead, c.directory.NewNonceURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to get nonce: %v", err)
+	}
+	resp.Body.Close()
+
+	return getNonce(resp)
+}
+
+func getNonce(resp *http.Response) (string, error) {
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("server did not respond with a proper nonce header")
+	}
+	return nonce, nil
+}
+
+func getSignatureAlgorithm(key crypto.PrivateKey) (jose.SignatureAlgorithm, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported key type %T", key)
+}
+
+// sign creates a JWS for url. When kid is empty the public key is embedded in
+// the protected header instead.
+func (c *acmeClient) sign(url string, key crypto.PrivateKey, kid string, nonceSource jose.NonceSource, payload []byte) (*jose.JSONWebSignature, error) {
+	alg, err := getSignatureAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &jose.SignerOptions{
+		NonceSource: nonceSource,
+		EmbedJWK:    kid == "",
+		ExtraHeaders: map[jose.HeaderKey]interface{}{
+			"url": url,
+		},
+	}
+	signer, err := jose.NewSigner(
+		jose.SigningKey{
+			Algorithm: alg,
+			Key:       jose.JSONWebKey{Key: key, KeyID: kid},
+		},
+		options,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signer: %v", err)
+	}
+
+	return signer.Sign(payload)
+}
+
+// post sends a request signed by key to the ACME server and decodes the
+// response in response if it is not nil. The request is retried when the
+// server rejects the nonce.
+func (c *acmeClient) post(url string, key crypto.PrivateKey, kid string, payload []byte, response interface{}) error {
+	var err error
+	for i := 0; i < 3; i++ {
+		err = c.signedPost(url, key, kid, payload, response)
+		if problem, ok := err.(*legoacme.ProblemDetails); !ok || problem.Type != legoacme.BadNonceErr {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *acmeClient) signedPost(url string, key crypto.PrivateKey, kid string, payload []byte, response interface{}) error {
+	signed, err := c.sign(url, key, kid, c, payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(http.MethodPost, url, []byte(signed.FullSerialize()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if nonce, err := getNonce(resp); err == nil {
+		c.nonces = append(c.nonces, nonce)
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		problem := &legoacme.ProblemDetails{}
+		if err = json.NewDecoder(resp.Body).Decode(problem); err != nil {
+			return fmt.Errorf("%s: unexpected status %d", url, resp.StatusCode)
+		}
+		problem.HTTPStatus = resp.StatusCode
+		problem.Method = http.MethodPost
+		problem.URL = url
+		return problem
+	}
+
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// keyChange replaces the key of the account by newKey on the ACME server as
+// described in https://tools.ietf.org/html/rfc8555#section-7.3.5
+func (c *acmeClient) keyChange(a *account, newKey crypto.PrivateKey) error {
+	if c.directory.KeyChangeURL == "" {
+		return errors.New("the ACME server does not support key rollover")
+	}
+
+	oldKey, ok := a.Key.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported key type %T", a.Key)
+	}
+
+	keyChange, err := json.Marshal(map[string]interface{}{
+		"account": a.Registration.URI,
+		"oldKey":  jose.JSONWebKey{Key: oldKey.Public()},
+	})
+	if err != nil {
+		return err
+	}
+
+	// The inner JWS is signed by the new key and must not have a nonce
+	inner, err := c.sign(c.directory.KeyChangeURL, newKey, "", nil, keyChange)
+	if err != nil {
+		return err
+	}
+
+	return c.post(c.directory.KeyChangeURL, a.Key, a.Registration.URI, []byte(inner.FullSerialize()), nil)
+}
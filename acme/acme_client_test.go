@@ -0,0 +1,29 @@
+package acme
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestACMEClientUserAgent(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		fmt.Fprint(w, `{}`)
+	}))
+	defer server.Close()
+
+	// user_agent is added in front of our own product, like lego does
+	_, err := newACMEClient(&account{ServerURL: server.URL, UserAgent: "vault-acme-test"})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(userAgent, "vault-acme-test vault-acme ("), userAgent)
+
+	_, err = newACMEClient(&account{ServerURL: server.URL})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(userAgent, "vault-acme ("), userAgent)
+}
@@ -2,35 +2,61 @@ package acme
 
 import (
 	"context"
+	"sync"
 
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/salt"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
 type backend struct {
 	*framework.Backend
-	cache *Cache
+	cache       *Cache
+	ledger      *Ledger
+	directories *directoryCache
+	// The changes of the terms of service already logged
+	termsOfServiceWarnings *termsOfServiceWarnings
+
+	view      logical.Storage
+	salt      *salt.Salt
+	saltMutex sync.RWMutex
 }
 
 // Factory creates a new ACME backend implementing logical.Backend
 func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend, error) {
-	b := backend{
-		cache: NewCache(),
+	b := &backend{
+		cache:                  NewCache(),
+		ledger:                 NewLedger(),
+		directories:            newDirectoryCache(),
+		termsOfServiceWarnings: newTermsOfServiceWarnings(),
+		view:                   conf.StorageView,
 	}
 
 	b.Backend = &framework.Backend{
 		BackendType: logical.TypeLogical,
+		Invalidate:  b.invalidate,
+		PathsSpecial: &logical.Paths{
+			// The account keys and the private keys of the certificates in
+			// the cache
+			SealWrapStorage: []string{
+				accountKeyPrefix,
+				cachePrefix,
+			},
+		},
 		Secrets: []*framework.Secret{
-			secretCert(&b),
+			secretCert(b),
 		},
 		Paths: framework.PathAppend(
-			pathAccounts(&b),
-			pathRoles(&b),
+			pathAccounts(b),
+			pathRoles(b),
+			pathProviders(b),
+			pathExport(b),
 			[]*framework.Path{
-				pathCerts(&b),
-				pathChallenges(&b),
-				pathCache(&b),
+				pathCerts(b),
+				pathChallenges(b),
+				pathCache(b),
+				pathUpgrade(b),
 			},
 		),
 	}
@@ -42,6 +68,40 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 	return b, nil
 }
 
+// Salt returns the salt of the mount, it is used to fingerprint the secrets
+// we do not want to disclose
+func (b *backend) Salt(ctx context.Context) (*salt.Salt, error) {
+	b.saltMutex.RLock()
+	if b.salt != nil {
+		defer b.saltMutex.RUnlock()
+		return b.salt, nil
+	}
+	b.saltMutex.RUnlock()
+
+	b.saltMutex.Lock()
+	defer b.saltMutex.Unlock()
+	if b.salt != nil {
+		return b.salt, nil
+	}
+	s, err := salt.NewSalt(ctx, b.view, &salt.Config{
+		HashFunc: salt.SHA256Hash,
+		Location: salt.DefaultLocation,
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.salt = s
+	return s, nil
+}
+
+func (b *backend) invalidate(ctx context.Context, key string) {
+	if key == salt.DefaultLocation {
+		b.saltMutex.Lock()
+		b.salt = nil
+		b.saltMutex.Unlock()
+	}
+}
+
 func (b *backend) pathExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
 	out, err := req.Storage.Get(ctx, req.Path)
 	if err != nil {
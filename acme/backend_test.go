@@ -2,6 +2,9 @@ package acme
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"fmt"
 	"os"
 	"os/exec"
@@ -9,6 +12,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/go-acme/lego/v3/registration"
+	"github.com/hashicorp/vault/sdk/helper/salt"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/remilapeyre/vault-acme/acme/sidecar"
 	"github.com/stretchr/testify/require"
@@ -77,6 +82,78 @@ func TestValidateNames(t *testing.T) {
 			Domain:   []string{"sentry.lenstra.fr", "foobar.fr"},
 			Expected: "'foobar.fr' is not an allowed domain",
 		},
+		{
+			R:        role{Account: "account", AllowedDomains: []string{"lenstra.fr"}, AllowBareDomains: true, AllowSubdomains: true},
+			Domain:   []string{"*.lenstra.fr"},
+			Expected: "'*.lenstra.fr' is a wildcard but the role does not allow wildcard certificates",
+		},
+		{
+			R:        role{Account: "account", AllowedDomains: []string{"lenstra.fr"}, AllowBareDomains: true, AllowSubdomains: true, AllowWildcardCertificates: true},
+			Domain:   []string{"lenstra.fr", "*.lenstra.fr"},
+			Expected: "",
+		},
+		{
+			R:        role{Account: "account", AllowedDomains: []string{"lenstra.fr"}, AllowBareDomains: true, AllowSubdomains: false, AllowWildcardCertificates: true},
+			Domain:   []string{"*.lenstra.fr"},
+			Expected: "'*.lenstra.fr' is not an allowed domain",
+		},
+		{
+			R:        role{Account: "account", AllowedDomains: []string{"lenstra.fr"}, AllowBareDomains: true, AllowSubdomains: true, AllowWildcardCertificates: true},
+			Domain:   []string{"*.*.lenstra.fr"},
+			Expected: "'*.*.lenstra.fr' is not a valid wildcard, only the leftmost label can be '*'",
+		},
+		{
+			R:        role{Account: "account", AllowedDomains: []string{"lenstra.fr"}, AllowBareDomains: true, AllowSubdomains: true, AllowWildcardCertificates: true},
+			Domain:   []string{"www*.lenstra.fr"},
+			Expected: "'www*.lenstra.fr' is not a valid wildcard, only the leftmost label can be '*'",
+		},
+		{
+			R:        role{Account: "account", AllowedDomains: []string{"*-api.prod.lenstra.fr"}},
+			Domain:   []string{"foo-api.prod.lenstra.fr"},
+			Expected: "'foo-api.prod.lenstra.fr' is not an allowed domain",
+		},
+		{
+			R:        role{Account: "account", AllowedDomains: []string{"*-api.prod.lenstra.fr"}, AllowGlobDomains: true},
+			Domain:   []string{"foo-api.prod.lenstra.fr", "bar-api.prod.lenstra.fr"},
+			Expected: "",
+		},
+		{
+			R:        role{Account: "account", AllowedDomains: []string{"*-api.prod.lenstra.fr"}, AllowGlobDomains: true},
+			Domain:   []string{"foo-web.prod.lenstra.fr"},
+			Expected: "'foo-web.prod.lenstra.fr' is not an allowed domain",
+		},
+		{
+			R: role{Account: "account", AllowSubdomains: true, DomainRules: map[string]domainRule{
+				"lenstra.fr":          {AllowBareDomains: boolPtr(true), AllowSubdomains: boolPtr(false)},
+				"internal.lenstra.fr": {},
+			}},
+			Domain:   []string{"lenstra.fr", "sentry.internal.lenstra.fr"},
+			Expected: "",
+		},
+		{
+			R: role{Account: "account", AllowSubdomains: true, DomainRules: map[string]domainRule{
+				"lenstra.fr":          {AllowBareDomains: boolPtr(true), AllowSubdomains: boolPtr(false)},
+				"internal.lenstra.fr": {},
+			}},
+			Domain:   []string{"internal.lenstra.fr"},
+			Expected: "'internal.lenstra.fr' is not an allowed domain",
+		},
+		{
+			R: role{Account: "account", DomainRules: map[string]domainRule{
+				"lenstra.fr":          {AllowSubdomains: boolPtr(true)},
+				"internal.lenstra.fr": {AllowSubdomains: boolPtr(true), AllowWildcardCertificates: boolPtr(true)},
+			}},
+			Domain:   []string{"*.internal.lenstra.fr"},
+			Expected: "",
+		},
+		{
+			R: role{Account: "account", DomainRules: map[string]domainRule{
+				"lenstra.fr":          {AllowSubdomains: boolPtr(true)},
+				"internal.lenstra.fr": {AllowSubdomains: boolPtr(true), AllowWildcardCertificates: boolPtr(true)},
+			}},
+			Domain:   []string{"*.lenstra.fr"},
+			Expected: "'*.lenstra.fr' is not an allowed domain",
+		},
 	}
 
 	for _, tc := range tcases {
@@ -146,6 +223,12 @@ func getTestConfig(t *testing.T) (*logical.BackendConfig, logical.Backend) {
 	})
 	time.Sleep(1 * time.Second)
 
+	return getInmemTestConfig(t)
+}
+
+// getInmemTestConfig returns a backend using an in-memory storage, it does
+// not start pebble so the tests using it must not contact the ACME server
+func getInmemTestConfig(t *testing.T) (*logical.BackendConfig, logical.Backend) {
 	config := logical.TestBackendConfig()
 	config.StorageView = &logical.InmemStorage{}
 	b, err := Factory(context.Background(), config)
@@ -173,6 +256,32 @@ func createAccount(t *testing.T, b logical.Backend, storage logical.Storage) {
 	makeRequest(t, b, req, "")
 }
 
+// newTestAccount returns an account that can be saved directly in storage,
+// without registering it on the ACME server
+func newTestAccount(t *testing.T) *account {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return &account{
+		Email:           "remi@lenstra.fr",
+		Key:             key,
+		KeyType:         "EC256",
+		Registration:    &registration.Resource{URI: "https://localhost:14000/my-account/1"},
+		ServerURL:       "https://localhost:14000/dir",
+		EnableHTTP01:    true,
+		RateLimitAction: rateLimitActionWarn,
+	}
+}
+
+// getTestHMAC returns the fingerprint the backend uses for value
+func getTestHMAC(t *testing.T, storage logical.Storage, value string) string {
+	s, err := salt.NewSalt(context.Background(), storage, &salt.Config{
+		HashFunc: salt.SHA256Hash,
+		Location: salt.DefaultLocation,
+	})
+	require.NoError(t, err)
+	return s.GetIdentifiedHMAC(value)
+}
+
 func createRole(t *testing.T, b logical.Backend, storage logical.Storage) {
 	req := &logical.Request{
 		Operation: logical.CreateOperation,
@@ -327,23 +436,23 @@ func TestRoles(t *testing.T) {
 	}{
 		{
 			RequestData:      map[string]interface{}{"account": "lenstra"},
-			ExpectedResponse: map[string]interface{}{"account": "lenstra", "allow_bare_domains": false, "allow_subdomains": false, "allowed_domains": []string{}, "cache_for_ratio": 70, "disable_cache": false},
+			ExpectedResponse: map[string]interface{}{"account": "lenstra", "allow_bare_domains": false, "allow_glob_domains": false, "allow_subdomains": false, "allow_wildcard_certificates": false, "allowed_domains": []string{}, "cache_for_ratio": 70, "challenge_preference": []string{}, "disable_cache": false, "domain_rules": map[string]domainRule{}, "key_type": "RSA2048"},
 		},
 		{
 			RequestData:      map[string]interface{}{"account": "lenstra", "allowed_domains": "sentry.lenstra.fr"},
-			ExpectedResponse: map[string]interface{}{"account": "lenstra", "allow_bare_domains": false, "allow_subdomains": false, "allowed_domains": []string{"sentry.lenstra.fr"}, "cache_for_ratio": 70, "disable_cache": false},
+			ExpectedResponse: map[string]interface{}{"account": "lenstra", "allow_bare_domains": false, "allow_glob_domains": false, "allow_subdomains": false, "allow_wildcard_certificates": false, "allowed_domains": []string{"sentry.lenstra.fr"}, "cache_for_ratio": 70, "challenge_preference": []string{}, "disable_cache": false, "domain_rules": map[string]domainRule{}, "key_type": "RSA2048"},
 		},
 		{
 			RequestData:      map[string]interface{}{"account": "lenstra", "allow_bare_domains": true},
-			ExpectedResponse: map[string]interface{}{"account": "lenstra", "allow_bare_domains": true, "allow_subdomains": false, "allowed_domains": []string{}, "cache_for_ratio": 70, "disable_cache": false},
+			ExpectedResponse: map[string]interface{}{"account": "lenstra", "allow_bare_domains": true, "allow_glob_domains": false, "allow_subdomains": false, "allow_wildcard_certificates": false, "allowed_domains": []string{}, "cache_for_ratio": 70, "challenge_preference": []string{}, "disable_cache": false, "domain_rules": map[string]domainRule{}, "key_type": "RSA2048"},
 		},
 		{
 			RequestData:      map[string]interface{}{"account": "lenstra", "allow_subdomains": true, "allowed_domains": []string{"lenstra.fr"}, "cache_for_ratio": 50},
-			ExpectedResponse: map[string]interface{}{"account": "lenstra", "allow_bare_domains": false, "allow_subdomains": true, "allowed_domains": []string{"lenstra.fr"}, "cache_for_ratio": 50, "disable_cache": false},
+			ExpectedResponse: map[string]interface{}{"account": "lenstra", "allow_bare_domains": false, "allow_glob_domains": false, "allow_subdomains": true, "allow_wildcard_certificates": false, "allowed_domains": []string{"lenstra.fr"}, "cache_for_ratio": 50, "challenge_preference": []string{}, "disable_cache": false, "domain_rules": map[string]domainRule{}, "key_type": "RSA2048"},
 		},
 		{
 			RequestData:      map[string]interface{}{"account": "lenstra", "allow_subdomains": true, "allowed_domains": []string{"lenstra.fr"}, "disable_cache": true},
-			ExpectedResponse: map[string]interface{}{"account": "lenstra", "allow_bare_domains": false, "allow_subdomains": true, "allowed_domains": []string{"lenstra.fr"}, "cache_for_ratio": 70, "disable_cache": true},
+			ExpectedResponse: map[string]interface{}{"account": "lenstra", "allow_bare_domains": false, "allow_glob_domains": false, "allow_subdomains": true, "allow_wildcard_certificates": false, "allowed_domains": []string{"lenstra.fr"}, "cache_for_ratio": 70, "challenge_preference": []string{}, "disable_cache": true, "domain_rules": map[string]domainRule{}, "key_type": "RSA2048"},
 		},
 	}
 	for _, tcase := range testCases {
@@ -380,12 +489,17 @@ func TestRoles(t *testing.T) {
 		t,
 		resp.Data,
 		map[string]interface{}{
-			"account":            "lenstra",
-			"allow_bare_domains": false,
-			"allow_subdomains":   true,
-			"allowed_domains":    []string{"lenstra.fr"},
-			"cache_for_ratio":    70,
-			"disable_cache":      false,
+			"account":                     "lenstra",
+			"allow_bare_domains":          false,
+			"allow_glob_domains":          false,
+			"allow_subdomains":            true,
+			"allow_wildcard_certificates": false,
+			"allowed_domains":             []string{"lenstra.fr"},
+			"cache_for_ratio":             70,
+			"challenge_preference":        []string{},
+			"disable_cache":               false,
+			"domain_rules":                map[string]domainRule{},
+			"key_type":                    "RSA2048",
 		},
 	)
 
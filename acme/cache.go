@@ -24,6 +24,8 @@ func NewCache() *Cache {
 }
 
 type CacheEntry struct {
+	SchemaVersion int `json:"schema_version"`
+
 	Users   int
 	Account string
 
@@ -40,6 +42,7 @@ type CacheEntry struct {
 
 func NewCacheEntry(account string, cert *certificate.Resource) *CacheEntry {
 	return &CacheEntry{
+		SchemaVersion:     cacheSchema.version(),
 		Users:             1,
 		Account:           account,
 		Domain:            cert.Domain,
@@ -82,21 +85,15 @@ func (c *Cache) Create(ctx context.Context, storage logical.Storage, role *role,
 }
 
 func (c *Cache) Read(ctx context.Context, storage logical.Storage, role *role, key string) (*CacheEntry, error) {
-	storageEntry, err := storage.Get(ctx, key)
+	ce := &CacheEntry{}
+	found, err := cacheSchema.decode(ctx, storage, key, ce)
 	if err != nil {
 		return nil, err
 	}
-	if storageEntry == nil {
+	if !found {
 		return nil, nil
 	}
 
-	// Something was found in the cache
-	ce := &CacheEntry{}
-	err = storageEntry.DecodeJSON(ce)
-	if err != nil {
-		return nil, err
-	}
-
 	// Before returning this entry, we have to make sure it is not stale
 	if role != nil {
 		cert := ce.Certificate()
@@ -132,6 +129,29 @@ func (c *Cache) Delete(ctx context.Context, storage logical.Storage, key string)
 	return storage.Delete(ctx, key)
 }
 
+// DeleteAccount removes the certificates issued for account from the cache
+func (c *Cache) DeleteAccount(ctx context.Context, storage logical.Storage, account string) error {
+	keys, err := c.List(ctx, storage)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		ce, err := c.Read(ctx, storage, nil, cachePrefix+key)
+		if err != nil {
+			return err
+		}
+		if ce == nil || ce.Account != account {
+			continue
+		}
+		if err = c.Delete(ctx, storage, cachePrefix+key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (c *Cache) Clear(ctx context.Context, storage logical.Storage) error {
 	keys, err := c.List(ctx, storage)
 	if err != nil {
@@ -2,54 +2,218 @@ package acme
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"strings"
 
+	legoacme "github.com/go-acme/lego/v3/acme"
 	"github.com/go-acme/lego/v3/certificate"
 	"github.com/go-acme/lego/v3/challenge/dns01"
 	"github.com/go-acme/lego/v3/lego"
-	"github.com/go-acme/lego/v3/providers/dns"
 	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
-func getCertFromACMEProvider(ctx context.Context, logger log.Logger, req *logical.Request, a *account, names []string) (*certificate.Resource, error) {
+const (
+	challengeDNS01     = "dns-01"
+	challengeHTTP01    = "http-01"
+	challengeTLSALPN01 = "tls-alpn-01"
+)
+
+// rateLimitedErrorType is the type of the problems returned by the CA when the
+// rate limits are exceeded
+const rateLimitedErrorType = "urn:ietf:params:acme:error:rateLimited"
+
+// The problems returned by the CA for the accounts it will not serve
+const (
+	unauthorizedErrorType        = "urn:ietf:params:acme:error:unauthorized"
+	accountDoesNotExistErrorType = "urn:ietf:params:acme:error:accountDoesNotExist"
+)
+
+// accountStatusDoesNotExist is the status reported for the accounts the CA
+// does not know
+const accountStatusDoesNotExist = "does_not_exist"
+
+var challengeTypes = []string{challengeDNS01, challengeHTTP01, challengeTLSALPN01}
+
+// validateChallengePreference checks that the challenge types are known and
+// that each of them is given only once
+func validateChallengePreference(preference []string) error {
+	seen := map[string]bool{}
+	for _, t := range preference {
+		if !strutil.StrListContains(challengeTypes, t) {
+			return fmt.Errorf("%q is not a supported challenge type, must be one of %s", t, strings.Join(challengeTypes, ", "))
+		}
+		if seen[t] {
+			return fmt.Errorf("%q is present multiple times in challenge_preference", t)
+		}
+		seen[t] = true
+	}
+	return nil
+}
+
+// challengeEnabled returns whether the account is configured to solve
+// challenges of type t
+func (a *account) challengeEnabled(t string) bool {
+	switch t {
+	case challengeDNS01:
+		return a.Provider != "" || a.DNSProvider != "" || len(a.DNSZoneProviders) > 0
+	case challengeHTTP01:
+		return a.EnableHTTP01
+	case challengeTLSALPN01:
+		return a.EnableTLSALPN01
+	default:
+		return false
+	}
+}
+
+// certificateKeyTypes are the types of private key that can be used for the
+// certificates, they differ from the ones of the accounts since some CAs
+// refuse RSA8192 while RSA3072 is common for certificates
+var certificateKeyTypes = []interface{}{"EC256", "EC384", "RSA2048", "RSA3072", "RSA4096"}
+
+func validateCertificateKeyType(keyType string) error {
+	for _, t := range certificateKeyTypes {
+		if t == keyType {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not a supported key type for certificates", keyType)
+}
+
+// generateCertificateKey generates the private key of a new certificate. lego
+// does not support RSA3072 so the key is generated here and given to lego with
+// the order.
+func generateCertificateKey(keyType string) (crypto.PrivateKey, error) {
+	switch keyType {
+	case "EC256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EC384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "RSA2048":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "RSA3072":
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case "RSA4096":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	default:
+		return nil, validateCertificateKeyType(keyType)
+	}
+}
+
+// ledgerRecorder records an event of the orders sent to the CA in the ledger
+type ledgerRecorder func(event string, err error) error
+
+// recordFailure records a failed order, the errors are only logged as the
+// order has already failed
+func recordFailure(logger log.Logger, record ledgerRecorder, err error) {
+	if lerr := record(ledgerEventFailure, err); lerr != nil {
+		logger.Error("Failed to record the failed order in the ledger", "error", lerr)
+	}
+}
+
+// getCertFromACMEProvider orders a certificate for names. When no preference
+// is given all the challenges enabled on the account are offered to lego,
+// otherwise they are tried one after the other and the order is retried with
+// the next challenge type when it fails. Each order and each failure is given
+// to record.
+func getCertFromACMEProvider(ctx context.Context, logger log.Logger, req *logical.Request, a *account, names []string, preference []string, keyType string, record ledgerRecorder) (*certificate.Resource, error) {
+	privateKey, err := generateCertificateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(preference) == 0 {
+		if err = record(ledgerEventOrder, nil); err != nil {
+			return nil, err
+		}
+		cert, err := obtainCertificate(ctx, logger, req, a, names, privateKey, "")
+		if err != nil {
+			recordFailure(logger, record, err)
+		}
+		return cert, err
+	}
+
+	var errs []string
+	for _, challengeType := range preference {
+		if !a.challengeEnabled(challengeType) {
+			logger.Debug("Skipping challenge type not enabled on the account", "challenge", challengeType)
+			continue
+		}
+
+		if err = record(ledgerEventOrder, nil); err != nil {
+			return nil, err
+		}
+		cert, err := obtainCertificate(ctx, logger, req, a, names, privateKey, challengeType)
+		if err == nil {
+			return cert, nil
+		}
+		recordFailure(logger, record, err)
+		errs = append(errs, fmt.Sprintf("%s: %s", challengeType, err))
+
+		// Trying again would only make things worse
+		var problem *legoacme.ProblemDetails
+		if errors.As(err, &problem) && problem.Type == rateLimitedErrorType {
+			break
+		}
+		logger.Warn("Failed to obtain certificate, trying the next challenge type", "challenge", challengeType, "error", err)
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("none of the challenge types in %s is enabled on the account", strings.Join(preference, ", "))
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+func obtainCertificate(ctx context.Context, logger log.Logger, req *logical.Request, a *account, names []string, privateKey crypto.PrivateKey, challengeType string) (*certificate.Resource, error) {
 	client, err := a.getClient()
 	if err != nil {
 		return nil, err
 	}
 
-	err = setupChallengeProviders(ctx, logger, client, a, req)
+	err = setupChallengeProviders(ctx, logger, client, a, req, challengeType)
 	if err != nil {
 		return nil, err
 	}
 
 	request := certificate.ObtainRequest{
-		Domains: names,
-		Bundle:  true,
+		Domains:    names,
+		Bundle:     true,
+		PrivateKey: privateKey,
 	}
 
 	return client.Certificate.Obtain(request)
 }
 
-func setupChallengeProviders(ctx context.Context, logger log.Logger, client *lego.Client, a *account, req *logical.Request) error {
+// setupChallengeProviders configures the providers of the challenges enabled
+// on the account, or only the one of challengeType when it is set
+func setupChallengeProviders(ctx context.Context, logger log.Logger, client *lego.Client, a *account, req *logical.Request, challengeType string) error {
 	// DNS-01
-	if a.Provider != "" {
-		provider, err := dns.NewDNSChallengeProviderByName(a.Provider, a.ProviderConfiguration)
+	if challengeType == "" || challengeType == challengeDNS01 {
+		provider, err := a.newDNS01Provider(ctx, req.Storage)
 		if err != nil {
 			return err
 		}
-
-		err = client.Challenge.SetDNS01Provider(
-			provider,
-			dns01.CondOption(len(a.DNSResolvers) > 0, dns01.AddRecursiveNameservers(a.DNSResolvers)),
-			dns01.CondOption(a.IgnoreDNSPropagation, dns01.DisableCompletePropagationRequirement()),
-		)
-		if err != nil {
-			return err
+		if provider != nil {
+			err = client.Challenge.SetDNS01Provider(
+				provider,
+				dns01.CondOption(len(a.DNSResolvers) > 0, dns01.AddRecursiveNameservers(a.DNSResolvers)),
+				dns01.CondOption(a.IgnoreDNSPropagation, dns01.DisableCompletePropagationRequirement()),
+			)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
 	// HTTP-01
-	if a.EnableHTTP01 {
+	if a.EnableHTTP01 && (challengeType == "" || challengeType == challengeHTTP01) {
 		provider := newVaultHTTP01Provider(ctx, logger, req)
 		err := client.Challenge.SetHTTP01Provider(provider)
 		if err != nil {
@@ -58,7 +222,7 @@ func setupChallengeProviders(ctx context.Context, logger log.Logger, client *leg
 	}
 
 	// TLS-ALPN-01
-	if a.EnableTLSALPN01 {
+	if a.EnableTLSALPN01 && (challengeType == "" || challengeType == challengeTLSALPN01) {
 		provider := newVaultTLSALPN01Provider(ctx, logger, req)
 		err := client.Challenge.SetTLSALPN01Provider(provider)
 		if err != nil {
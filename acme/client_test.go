@@ -0,0 +1,106 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"testing"
+
+	legoacme "github.com/go-acme/lego/v3/acme"
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChallengeEnabled(t *testing.T) {
+	a := &account{EnableTLSALPN01: true}
+	require.False(t, a.challengeEnabled(challengeDNS01))
+	require.False(t, a.challengeEnabled(challengeHTTP01))
+	require.True(t, a.challengeEnabled(challengeTLSALPN01))
+
+	a = &account{DNSZoneProviders: map[string]string{"lenstra.fr": "route53"}}
+	require.True(t, a.challengeEnabled(challengeDNS01))
+	require.False(t, a.challengeEnabled("foo"))
+}
+
+func TestChallengePreferenceNotEnabled(t *testing.T) {
+	a := &account{EnableHTTP01: false}
+	req := &logical.Request{Storage: &logical.InmemStorage{}}
+
+	var events []string
+	record := func(event string, err error) error {
+		events = append(events, event)
+		return nil
+	}
+	_, err := getCertFromACMEProvider(context.Background(), log.NewNullLogger(), req, a, []string{"lenstra.fr"}, []string{challengeHTTP01, challengeDNS01}, "EC256", record)
+	require.EqualError(t, err, "none of the challenge types in http-01, dns-01 is enabled on the account")
+	// No order has been sent to the CA
+	require.Empty(t, events)
+}
+
+func TestChallengePreferenceRecordsEachOrder(t *testing.T) {
+	// Nothing listens on this port so each order fails right away
+	a := &account{
+		ServerURL:             "http://127.0.0.1:1/dir",
+		EnableHTTP01:          true,
+		Provider:              "exec",
+		ProviderConfiguration: map[string]string{"EXEC_PATH": "/dev/null"},
+	}
+	req := &logical.Request{Storage: &logical.InmemStorage{}}
+
+	var events []string
+	record := func(event string, err error) error {
+		events = append(events, event)
+		return nil
+	}
+	_, err := getCertFromACMEProvider(context.Background(), log.NewNullLogger(), req, a, []string{"lenstra.fr"}, []string{challengeHTTP01, challengeDNS01}, "EC256", record)
+	require.Error(t, err)
+	require.Equal(t, []string{ledgerEventOrder, ledgerEventFailure, ledgerEventOrder, ledgerEventFailure}, events)
+
+	// The order is not sent when it cannot be recorded
+	record = func(event string, err error) error {
+		return errors.New("storage is sealed")
+	}
+	_, err = getCertFromACMEProvider(context.Background(), log.NewNullLogger(), req, a, []string{"lenstra.fr"}, []string{challengeHTTP01, challengeDNS01}, "EC256", record)
+	require.EqualError(t, err, "storage is sealed")
+}
+
+func TestGetAccountProblemStatus(t *testing.T) {
+	status, detail, ok := getAccountProblemStatus(&legoacme.ProblemDetails{Type: unauthorizedErrorType, Detail: "Account has been deactivated"})
+	require.True(t, ok)
+	require.Equal(t, "deactivated", status)
+	require.Equal(t, "Account has been deactivated", detail)
+
+	status, _, ok = getAccountProblemStatus(&legoacme.ProblemDetails{Type: unauthorizedErrorType, Detail: `Account is not valid, has status "revoked"`})
+	require.True(t, ok)
+	require.Equal(t, "revoked", status)
+
+	// The CA also answers unauthorized for requests it refuses for other
+	// reasons
+	_, _, ok = getAccountProblemStatus(&legoacme.ProblemDetails{Type: unauthorizedErrorType, Detail: "JWS verification error"})
+	require.False(t, ok)
+
+	status, _, ok = getAccountProblemStatus(fmt.Errorf("query: %w", &legoacme.ProblemDetails{Type: accountDoesNotExistErrorType}))
+	require.True(t, ok)
+	require.Equal(t, "does_not_exist", status)
+
+	_, _, ok = getAccountProblemStatus(&legoacme.ProblemDetails{Type: rateLimitedErrorType})
+	require.False(t, ok)
+	_, _, ok = getAccountProblemStatus(errors.New("connection refused"))
+	require.False(t, ok)
+}
+
+func TestGenerateCertificateKey(t *testing.T) {
+	key, err := generateCertificateKey("EC384")
+	require.NoError(t, err)
+	require.Equal(t, 384, key.(*ecdsa.PrivateKey).Params().BitSize)
+
+	key, err = generateCertificateKey("RSA3072")
+	require.NoError(t, err)
+	require.Equal(t, 3072, key.(*rsa.PrivateKey).N.BitLen())
+
+	_, err = generateCertificateKey("RSA8192")
+	require.EqualError(t, err, `"RSA8192" is not a supported key type for certificates`)
+}
@@ -0,0 +1,118 @@
+package acme
+
+import (
+	"sync"
+	"time"
+)
+
+// directoryCacheTTL is how long a directory is kept before being fetched again
+const directoryCacheTTL = time.Hour
+
+// directoryFailureTTL is how long a failure to fetch a directory is kept so an
+// unreachable CA does not make each request wait for the timeout
+const directoryFailureTTL = time.Minute
+
+type directoryCacheEntry struct {
+	directory *directory
+	err       error
+	fetchedAt time.Time
+}
+
+func (e directoryCacheEntry) fresh() bool {
+	if e.err != nil {
+		return time.Since(e.fetchedAt) < directoryFailureTTL
+	}
+	return time.Since(e.fetchedAt) < directoryCacheTTL
+}
+
+// directoryCacheKey identifies a directory along with the settings of the
+// client used to fetch it, the accounts using the same server with other
+// settings may not get the same result
+type directoryCacheKey struct {
+	serverURL   string
+	caBundle    string
+	httpProxy   string
+	httpTimeout int
+}
+
+func getDirectoryCacheKey(a *account) directoryCacheKey {
+	return directoryCacheKey{
+		serverURL:   a.ServerURL,
+		caBundle:    a.CABundle,
+		httpProxy:   a.HTTPProxy,
+		httpTimeout: a.HTTPTimeout,
+	}
+}
+
+// directoryCache keeps the ACME directories in memory so we do not fetch them
+// on each request. The lock is never held while contacting a CA.
+type directoryCache struct {
+	sync.Mutex
+	entries map[directoryCacheKey]directoryCacheEntry
+	// The directories being fetched in the background
+	refreshing map[directoryCacheKey]bool
+}
+
+func newDirectoryCache() *directoryCache {
+	return &directoryCache{
+		entries:    map[directoryCacheKey]directoryCacheEntry{},
+		refreshing: map[directoryCacheKey]bool{},
+	}
+}
+
+// Get returns the directory of the account, from the cache when possible
+func (c *directoryCache) Get(a *account, refresh bool) (*directory, time.Time, error) {
+	if !refresh {
+		c.Lock()
+		entry, ok := c.entries[getDirectoryCacheKey(a)]
+		c.Unlock()
+		if ok && entry.fresh() {
+			return entry.directory, entry.fetchedAt, entry.err
+		}
+	}
+
+	entry := c.fetch(a)
+	return entry.directory, entry.fetchedAt, entry.err
+}
+
+// Cached returns the directory of the account only when it is in the cache,
+// it never contacts the CA. When the directory is missing or outdated it is
+// fetched in the background for the next calls.
+func (c *directoryCache) Cached(a *account) *directory {
+	c.Lock()
+	defer c.Unlock()
+
+	key := getDirectoryCacheKey(a)
+	entry, ok := c.entries[key]
+	if ok && entry.fresh() {
+		return entry.directory
+	}
+
+	if !c.refreshing[key] {
+		c.refreshing[key] = true
+		go func() {
+			c.fetch(a)
+			c.Lock()
+			delete(c.refreshing, key)
+			c.Unlock()
+		}()
+	}
+
+	return nil
+}
+
+func (c *directoryCache) fetch(a *account) directoryCacheEntry {
+	entry := directoryCacheEntry{fetchedAt: time.Now()}
+	client, err := newACMEClient(a)
+	if err != nil {
+		entry.err = err
+	} else {
+		entry.directory = &client.directory
+	}
+
+	c.Lock()
+	c.entries[getDirectoryCacheKey(a)] = entry
+	c.Unlock()
+
+	return entry
+}
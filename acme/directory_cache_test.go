@@ -0,0 +1,68 @@
+package acme
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectoryCache(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		fmt.Fprint(w, `{"newNonce": "https://localhost/nonce", "meta": {"termsOfService": "https://localhost/terms.pdf"}}`)
+	}))
+	defer server.Close()
+
+	c := newDirectoryCache()
+	a := &account{ServerURL: server.URL}
+
+	// The directory is only fetched in the background
+	require.Nil(t, c.Cached(a))
+	require.Eventually(t, func() bool { return c.Cached(a) != nil }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "https://localhost/terms.pdf", c.Cached(a).Meta.TermsOfService)
+
+	dir, _, err := c.Get(a, false)
+	require.NoError(t, err)
+	require.Equal(t, "https://localhost/nonce", dir.NewNonceURL)
+	require.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	_, _, err = c.Get(a, true)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&hits))
+
+	// The failures are cached too
+	server.Close()
+	_, fetchedAt, err := c.Get(a, true)
+	require.Error(t, err)
+	_, cachedAt, cachedErr := c.Get(a, false)
+	require.Equal(t, err, cachedErr)
+	require.Equal(t, fetchedAt, cachedAt)
+	require.Nil(t, c.Cached(a))
+}
+
+func TestDirectoryCacheClientSettings(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"newNonce": "https://localhost/nonce"}`)
+	}))
+	defer server.Close()
+
+	c := newDirectoryCache()
+	broken := &account{ServerURL: server.URL, CABundle: "foo"}
+	_, _, brokenErr := c.Get(broken, false)
+	require.Error(t, brokenErr)
+
+	// The failure of an account with a broken ca_bundle is not reported for
+	// the other accounts using the same server
+	dir, _, err := c.Get(&account{ServerURL: server.URL}, false)
+	require.NoError(t, err)
+	require.Equal(t, "https://localhost/nonce", dir.NewNonceURL)
+
+	_, _, cachedErr := c.Get(broken, false)
+	require.Equal(t, brokenErr, cachedErr)
+}
@@ -0,0 +1,288 @@
+package acme
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/net/publicsuffix"
+)
+
+const ledgerPrefix = "ledger/"
+
+// statsPrefix is where the statistics of the accounts are stored, contrary to
+// the ledger they are never pruned
+const statsPrefix = "stats/"
+
+const (
+	// ledgerRetention is how long events are kept, it matches the longest
+	// window used by Let's Encrypt for its rate limits
+	ledgerRetention = 7 * 24 * time.Hour
+
+	certificatesWindow      = 7 * 24 * time.Hour
+	failedValidationsWindow = time.Hour
+)
+
+const (
+	ledgerEventOrder   = "order"
+	ledgerEventSuccess = "success"
+	ledgerEventFailure = "failure"
+)
+
+// Ledger records the orders made by each account so we can tell when the rate
+// limits of the CA are about to be reached. Contrary to the cache, its methods
+// take the lock themselves as it must not be held while ordering certificates.
+type Ledger struct {
+	*sync.Mutex
+}
+
+func NewLedger() *Ledger {
+	return &Ledger{
+		&sync.Mutex{},
+	}
+}
+
+type LedgerEvent struct {
+	Time  time.Time
+	Type  string
+	Names []string
+	Error string `json:",omitempty"`
+}
+
+// LedgerEntry holds the events of an account for a registered domain
+type LedgerEntry struct {
+	Events []LedgerEvent
+}
+
+// count returns the number of events of type t since the given time
+func (e *LedgerEntry) count(t string, since time.Time) int {
+	var n int
+	for _, event := range e.Events {
+		if event.Type == t && event.Time.After(since) {
+			n++
+		}
+	}
+	return n
+}
+
+func (e *LedgerEntry) prune(now time.Time) {
+	events := []LedgerEvent{}
+	for _, event := range e.Events {
+		if now.Sub(event.Time) < ledgerRetention {
+			events = append(events, event)
+		}
+	}
+	e.Events = events
+}
+
+// getRegisteredDomain returns the domain registered at the public suffix for
+// name, e.g. lenstra.fr for sentry.lenstra.fr
+func getRegisteredDomain(name string) string {
+	name = strings.TrimPrefix(strings.ToLower(name), "*.")
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return name
+	}
+	return domain
+}
+
+// getRegisteredDomains groups names by registered domain
+func getRegisteredDomains(names []string) map[string][]string {
+	domains := map[string][]string{}
+	for _, name := range names {
+		domain := getRegisteredDomain(name)
+		domains[domain] = append(domains[domain], name)
+	}
+	return domains
+}
+
+// AccountStats summarizes the certificates requested by an account
+type AccountStats struct {
+	CertificatesIssued int
+	LastSuccess        time.Time
+	LastFailure        time.Time
+	LastError          string
+}
+
+func statsPath(account string) string {
+	return statsPrefix + account
+}
+
+func (l *Ledger) Stats(ctx context.Context, storage logical.Storage, account string) (*AccountStats, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.stats(ctx, storage, account)
+}
+
+func (l *Ledger) stats(ctx context.Context, storage logical.Storage, account string) (*AccountStats, error) {
+	storageEntry, err := storage.Get(ctx, statsPath(account))
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &AccountStats{}
+	if storageEntry == nil {
+		return stats, nil
+	}
+	if err = storageEntry.DecodeJSON(stats); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// updateStats records the outcome of an order in the statistics of the account
+func (l *Ledger) updateStats(ctx context.Context, storage logical.Storage, account, eventType string, now time.Time, eventErr error) error {
+	stats, err := l.stats(ctx, storage, account)
+	if err != nil {
+		return err
+	}
+
+	switch eventType {
+	case ledgerEventSuccess:
+		stats.CertificatesIssued++
+		stats.LastSuccess = now
+	case ledgerEventFailure:
+		stats.LastFailure = now
+		if eventErr != nil {
+			stats.LastError = eventErr.Error()
+		}
+	default:
+		return nil
+	}
+
+	storageEntry, err := logical.StorageEntryJSON(statsPath(account), stats)
+	if err != nil {
+		return fmt.Errorf("failed to create stats entry: %v", err)
+	}
+	return storage.Put(ctx, storageEntry)
+}
+
+// DeleteStats removes the statistics of the account
+func (l *Ledger) DeleteStats(ctx context.Context, storage logical.Storage, account string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	return storage.Delete(ctx, statsPath(account))
+}
+
+func ledgerPath(account, domain string) string {
+	return ledgerPrefix + account + "/" + domain
+}
+
+func (l *Ledger) Read(ctx context.Context, storage logical.Storage, account, domain string) (*LedgerEntry, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.read(ctx, storage, account, domain)
+}
+
+func (l *Ledger) read(ctx context.Context, storage logical.Storage, account, domain string) (*LedgerEntry, error) {
+	storageEntry, err := storage.Get(ctx, ledgerPath(account, domain))
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &LedgerEntry{Events: []LedgerEvent{}}
+	if storageEntry == nil {
+		return entry, nil
+	}
+	if err = storageEntry.DecodeJSON(entry); err != nil {
+		return nil, err
+	}
+	entry.prune(time.Now())
+
+	return entry, nil
+}
+
+// Record adds an event for names to the ledger of the account
+func (l *Ledger) Record(ctx context.Context, storage logical.Storage, account, eventType string, names []string, eventErr error) error {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	for domain, domainNames := range getRegisteredDomains(names) {
+		entry, err := l.read(ctx, storage, account, domain)
+		if err != nil {
+			return err
+		}
+
+		event := LedgerEvent{
+			Time:  now,
+			Type:  eventType,
+			Names: domainNames,
+		}
+		if eventErr != nil {
+			event.Error = eventErr.Error()
+		}
+		entry.Events = append(entry.Events, event)
+
+		storageEntry, err := logical.StorageEntryJSON(ledgerPath(account, domain), entry)
+		if err != nil {
+			return fmt.Errorf("failed to create ledger entry: %v", err)
+		}
+		if err = storage.Put(ctx, storageEntry); err != nil {
+			return err
+		}
+	}
+
+	return l.updateStats(ctx, storage, account, eventType, now, eventErr)
+}
+
+// Check returns an error describing the limits of the account that a new
+// order for names would exceed
+func (l *Ledger) Check(ctx context.Context, storage logical.Storage, account string, a *account, names []string) error {
+	if a.CertificatesPerDomainLimit == 0 && a.FailedValidationsLimit == 0 {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	for domain := range getRegisteredDomains(names) {
+		entry, err := l.read(ctx, storage, account, domain)
+		if err != nil {
+			return err
+		}
+
+		if a.CertificatesPerDomainLimit > 0 {
+			if n := entry.count(ledgerEventSuccess, now.Add(-certificatesWindow)); n >= a.CertificatesPerDomainLimit {
+				return fmt.Errorf("%d certificates were issued for %s in the last week, the limit is %d", n, domain, a.CertificatesPerDomainLimit)
+			}
+		}
+		if a.FailedValidationsLimit > 0 {
+			if n := entry.count(ledgerEventFailure, now.Add(-failedValidationsWindow)); n >= a.FailedValidationsLimit {
+				return fmt.Errorf("%d validations failed for %s in the last hour, the limit is %d", n, domain, a.FailedValidationsLimit)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (l *Ledger) List(ctx context.Context, storage logical.Storage, account string) ([]string, error) {
+	return storage.List(ctx, ledgerPrefix+account+"/")
+}
+
+func (l *Ledger) Clear(ctx context.Context, storage logical.Storage, account string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	domains, err := l.List(ctx, storage, account)
+	if err != nil {
+		return err
+	}
+
+	for _, domain := range domains {
+		if err = storage.Delete(ctx, ledgerPath(account, domain)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package acme
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetRegisteredDomains(t *testing.T) {
+	domains := getRegisteredDomains([]string{"lenstra.fr", "*.lenstra.fr", "www.Lenstra.fr", "foo.bar.co.uk", "localhost"})
+	require.Equal(t, map[string][]string{
+		"lenstra.fr": {"lenstra.fr", "*.lenstra.fr", "www.Lenstra.fr"},
+		"bar.co.uk":  {"foo.bar.co.uk"},
+		"localhost":  {"localhost"},
+	}, domains)
+}
+
+func TestLedger(t *testing.T) {
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	l := NewLedger()
+	a := &account{
+		CertificatesPerDomainLimit: 2,
+		FailedValidationsLimit:     1,
+	}
+	names := []string{"lenstra.fr", "www.lenstra.fr"}
+
+	require.NoError(t, l.Check(ctx, storage, "foo", a, names))
+
+	require.NoError(t, l.Record(ctx, storage, "foo", ledgerEventSuccess, names, nil))
+	require.NoError(t, l.Check(ctx, storage, "foo", a, names))
+	require.NoError(t, l.Record(ctx, storage, "foo", ledgerEventSuccess, names, nil))
+	require.EqualError(t, l.Check(ctx, storage, "foo", a, names), "2 certificates were issued for lenstra.fr in the last week, the limit is 2")
+
+	// Other accounts and domains have their own limits
+	require.NoError(t, l.Check(ctx, storage, "bar", a, names))
+	require.NoError(t, l.Check(ctx, storage, "foo", a, []string{"example.com"}))
+
+	require.NoError(t, l.Record(ctx, storage, "foo", ledgerEventFailure, []string{"example.com"}, fmt.Errorf("boom")))
+	require.EqualError(t, l.Check(ctx, storage, "foo", a, []string{"example.com"}), "1 validations failed for example.com in the last hour, the limit is 1")
+
+	entry, err := l.Read(ctx, storage, "foo", "example.com")
+	require.NoError(t, err)
+	require.Len(t, entry.Events, 1)
+	require.Equal(t, "boom", entry.Events[0].Error)
+
+	domains, err := l.List(ctx, storage, "foo")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"lenstra.fr", "example.com"}, domains)
+
+	stats, err := l.Stats(ctx, storage, "foo")
+	require.NoError(t, err)
+	require.Equal(t, 2, stats.CertificatesIssued)
+	require.False(t, stats.LastSuccess.IsZero())
+	require.False(t, stats.LastFailure.IsZero())
+	require.Equal(t, "boom", stats.LastError)
+
+	// The statistics are kept when the ledger is cleared
+	require.NoError(t, l.Clear(ctx, storage, "foo"))
+	stats, err = l.Stats(ctx, storage, "foo")
+	require.NoError(t, err)
+	require.Equal(t, 2, stats.CertificatesIssued)
+	require.NoError(t, l.DeleteStats(ctx, storage, "foo"))
+	stats, err = l.Stats(ctx, storage, "foo")
+	require.NoError(t, err)
+	require.Equal(t, &AccountStats{}, stats)
+
+	domains, err = l.List(ctx, storage, "foo")
+	require.NoError(t, err)
+	require.Empty(t, domains)
+}
+
+func TestLedgerPrune(t *testing.T) {
+	now := time.Now()
+	entry := &LedgerEntry{
+		Events: []LedgerEvent{
+			{Time: now.Add(-8 * 24 * time.Hour), Type: ledgerEventSuccess},
+			{Time: now.Add(-2 * time.Hour), Type: ledgerEventFailure},
+			{Time: now.Add(-time.Minute), Type: ledgerEventSuccess},
+		},
+	}
+	entry.prune(now)
+	require.Len(t, entry.Events, 2)
+	require.Equal(t, 1, entry.count(ledgerEventSuccess, now.Add(-certificatesWindow)))
+	require.Equal(t, 0, entry.count(ledgerEventFailure, now.Add(-failedValidationsWindow)))
+}
@@ -2,8 +2,15 @@ package acme
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	legoacme "github.com/go-acme/lego/v3/acme"
 	"github.com/go-acme/lego/v3/certcrypto"
 	"github.com/go-acme/lego/v3/registration"
 	"github.com/hashicorp/errwrap"
@@ -11,6 +18,43 @@ import (
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
+// directoryAliases are the names that can be used in server_url instead of
+// the directory URL of well-known ACME CAs
+var directoryAliases = map[string]string{
+	"letsencrypt":         "https://acme-v02.api.letsencrypt.org/directory",
+	"letsencrypt-staging": "https://acme-staging-v02.api.letsencrypt.org/directory",
+	"zerossl":             "https://acme.zerossl.com/v2/DV90",
+	"buypass":             "https://api.buypass.com/acme/directory",
+	"buypass-staging":     "https://api.test4.buypass.no/acme/directory",
+	"google":              "https://dv.acme-v02.api.pki.goog/directory",
+	"google-staging":      "https://dv.acme-v02.test-api.pki.goog/directory",
+}
+
+// resolveServerURL returns the directory URL for serverURL and the alias that
+// was used, if any
+func resolveServerURL(serverURL string) (string, string, error) {
+	if u, ok := directoryAliases[serverURL]; ok {
+		return u, serverURL, nil
+	}
+
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		aliases := make([]string, 0, len(directoryAliases))
+		for alias := range directoryAliases {
+			aliases = append(aliases, alias)
+		}
+		sort.Strings(aliases)
+		return "", "", fmt.Errorf("server_url must be an URL or one of %s", strings.Join(aliases, ", "))
+	}
+
+	return serverURL, "", nil
+}
+
+const (
+	rateLimitActionWarn = "warn"
+	rateLimitActionDeny = "deny"
+)
+
 var keyTypes = []interface{}{
 	"EC256",
 	"EC384",
@@ -48,14 +92,23 @@ func pathAccounts(b *backend) []*framework.Path {
 					Default:       "EC256",
 					AllowedValues: keyTypes,
 				},
-				// TODO(remi): We should have a list of those so we can request certs
-				// for domains registred to different providers
 				"provider": {
 					Type: framework.TypeString,
 				},
 				"provider_configuration": {
 					Type: framework.TypeKVPairs,
 				},
+				// The name of a provider stored under providers/, it cannot
+				// be used with provider and provider_configuration
+				"dns_provider": {
+					Type: framework.TypeString,
+				},
+				// A mapping from DNS zones to the name of the provider to use
+				// for them, provider or dns_provider are used for the domains
+				// that do not match any zone
+				"dns_zone_providers": {
+					Type: framework.TypeKVPairs,
+				},
 				"enable_http_01": {
 					Type: framework.TypeBool,
 				},
@@ -65,6 +118,22 @@ func pathAccounts(b *backend) []*framework.Path {
 				"dns_resolvers": {
 					Type: framework.TypeStringSlice,
 				},
+				// Override the settings of the DNS provider, 0 keeps the
+				// ones of the provider
+				"propagation_timeout": {
+					Type: framework.TypeDurationSecond,
+				},
+				"polling_interval": {
+					Type: framework.TypeDurationSecond,
+				},
+				"txt_ttl": {
+					Type: framework.TypeInt,
+				},
+				// The challenge types to try in order, all the enabled
+				// challenges are offered at once when empty
+				"challenge_preference": {
+					Type: framework.TypeCommaStringSlice,
+				},
 				"ignore_dns_propagation": {
 					Type:    framework.TypeBool,
 					Default: false,
@@ -73,6 +142,48 @@ func pathAccounts(b *backend) []*framework.Path {
 					Type:     framework.TypeString,
 					Required: true,
 				},
+				"eab_kid": {
+					Type: framework.TypeString,
+				},
+				// Only used when deleting the account, it skips both the
+				// check that the account is deactivated and the one that it
+				// is not used by roles
+				"force": {
+					Type: framework.TypeBool,
+				},
+				"ca_bundle": {
+					Type: framework.TypeString,
+				},
+				"http_proxy": {
+					Type: framework.TypeString,
+				},
+				"http_timeout": {
+					Type: framework.TypeDurationSecond,
+				},
+				"user_agent": {
+					Type: framework.TypeString,
+				},
+				"certificates_per_domain_limit": {
+					Type: framework.TypeInt,
+				},
+				"failed_validations_limit": {
+					Type: framework.TypeInt,
+				},
+				"rate_limit_action": {
+					Type:          framework.TypeString,
+					Default:       rateLimitActionWarn,
+					AllowedValues: []interface{}{rateLimitActionWarn, rateLimitActionDeny},
+				},
+				// An existing account key, the registration will be looked up
+				// instead of creating a new one
+				"private_key": {
+					Type: framework.TypeString,
+				},
+				// The HMAC key is only needed during the registration and is
+				// never persisted
+				"eab_hmac_key": {
+					Type: framework.TypeString,
+				},
 			},
 			ExistenceCheck: b.pathExistenceCheck,
 			Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -82,6 +193,164 @@ func pathAccounts(b *backend) []*framework.Path {
 				logical.DeleteOperation: b.accountDelete,
 			},
 		},
+		{
+			Pattern: "accounts/" + framework.GenericNameRegex("account") + "/provider_configuration/" + framework.GenericNameRegex("key"),
+			Fields: map[string]*framework.FieldSchema{
+				"account": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+				"key": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+				"value": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.accountProviderConfigurationWrite,
+				logical.DeleteOperation: b.accountProviderConfigurationDelete,
+			},
+		},
+		{
+			Pattern: "accounts/" + framework.GenericNameRegex("account") + "/deactivate",
+			Fields: map[string]*framework.FieldSchema{
+				"account": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.accountDeactivate,
+			},
+		},
+		{
+			Pattern: "accounts/" + framework.GenericNameRegex("account") + "/migrate",
+			Fields: map[string]*framework.FieldSchema{
+				"account": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+				"server_url": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+				"terms_of_service_agreed": {
+					Type:    framework.TypeBool,
+					Default: false,
+				},
+				"regenerate_key": {
+					Type:    framework.TypeBool,
+					Default: false,
+				},
+				"key_type": {
+					Type:          framework.TypeString,
+					AllowedValues: keyTypes,
+				},
+				"eab_kid": {
+					Type: framework.TypeString,
+				},
+				"eab_hmac_key": {
+					Type: framework.TypeString,
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.accountMigrate,
+			},
+		},
+		{
+			Pattern: "accounts/" + framework.GenericNameRegex("account") + "/agree-terms",
+			Fields: map[string]*framework.FieldSchema{
+				"account": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.accountAgreeTerms,
+			},
+		},
+		{
+			Pattern: "accounts/" + framework.GenericNameRegex("account") + "/directory",
+			Fields: map[string]*framework.FieldSchema{
+				"account": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+				"refresh": {
+					Type: framework.TypeBool,
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.accountDirectory,
+			},
+		},
+		{
+			Pattern: "accounts/" + framework.GenericNameRegex("account") + "/status",
+			Fields: map[string]*framework.FieldSchema{
+				"account": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+			},
+			// Reading only reports the status, updating also saves the
+			// registration returned by the CA
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.accountStatus,
+				logical.UpdateOperation: b.accountStatus,
+			},
+		},
+		{
+			Pattern: "accounts/" + framework.GenericNameRegex("account") + "/ledger",
+			Fields: map[string]*framework.FieldSchema{
+				"account": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.accountLedgerRead,
+				logical.DeleteOperation: b.accountLedgerDelete,
+			},
+		},
+		{
+			Pattern: "accounts/" + framework.GenericNameRegex("account") + "/test-provider",
+			Fields: map[string]*framework.FieldSchema{
+				"account": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+				"domain": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+				// Defaults to the propagation timeout of the provider
+				"timeout": {
+					Type: framework.TypeDurationSecond,
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.accountTestProvider,
+			},
+		},
+		{
+			Pattern: "accounts/" + framework.GenericNameRegex("account") + "/rotate-key",
+			Fields: map[string]*framework.FieldSchema{
+				"account": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+				"key_type": {
+					Type:          framework.TypeString,
+					AllowedValues: keyTypes,
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.accountRotateKey,
+			},
+		},
 	}
 }
 
@@ -106,23 +375,132 @@ func (b *backend) accountWrite(ctx context.Context, req *logical.Request, data *
 	if err := data.Validate(); err != nil {
 		return nil, err
 	}
-	serverURL := data.Get("server_url").(string)
+	serverURL, serverURLAlias, err := resolveServerURL(data.Get("server_url").(string))
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
 	contact := data.Get("contact").(string)
 	termsOfServiceAgreed := data.Get("terms_of_service_agreed").(bool)
 	provider := data.Get("provider").(string)
 	providerConfiguration := data.Get("provider_configuration").(map[string]string)
+	dnsProvider := data.Get("dns_provider").(string)
+	dnsZoneProviders := data.Get("dns_zone_providers").(map[string]string)
 	enableHTTP01 := data.Get("enable_http_01").(bool)
 	enableTLSALPN01 := data.Get("enable_tls_alpn_01").(bool)
 	dnsResolvers := data.Get("dns_resolvers").([]string)
+	propagationTimeout := data.Get("propagation_timeout").(int)
+	pollingInterval := data.Get("polling_interval").(int)
+	txtTTL := data.Get("txt_ttl").(int)
 	ignoreDNSPropagation := data.Get("ignore_dns_propagation").(bool)
+	eabKeyID := data.Get("eab_kid").(string)
+	eabHMACKey := data.Get("eab_hmac_key").(string)
+
+	privateKeyPEM := data.Get("private_key").(string)
+	caBundle := data.Get("ca_bundle").(string)
+	httpProxy := data.Get("http_proxy").(string)
+	httpTimeout := data.Get("http_timeout").(int)
+	userAgent := data.Get("user_agent").(string)
+	certificatesPerDomainLimit := data.Get("certificates_per_domain_limit").(int)
+	failedValidationsLimit := data.Get("failed_validations_limit").(int)
+	rateLimitAction := data.Get("rate_limit_action").(string)
+	challengePreference := data.Get("challenge_preference").([]string)
+
+	// The names of the lego providers used by the account
+	providerNames := []string{}
+	if provider != "" {
+		providerNames = append(providerNames, provider)
+	}
+	if dnsProvider != "" {
+		if provider != "" || len(providerConfiguration) > 0 {
+			return logical.ErrorResponse("dns_provider cannot be used with provider and provider_configuration"), nil
+		}
+		p, err := getProvider(ctx, req.Storage, "providers/"+dnsProvider)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			return logical.ErrorResponse("This provider does not exists"), nil
+		}
+		providerNames = append(providerNames, p.Provider)
+	}
+	for zone, name := range dnsZoneProviders {
+		p, err := getProvider(ctx, req.Storage, "providers/"+name)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			return logical.ErrorResponse("The provider %q for zone %q does not exists", name, zone), nil
+		}
+		providerNames = append(providerNames, p.Provider)
+	}
+	if (eabKeyID == "") != (eabHMACKey == "") {
+		return logical.ErrorResponse("eab_kid and eab_hmac_key must be set together"), nil
+	}
+	if eabKeyID != "" && privateKeyPEM != "" {
+		return logical.ErrorResponse("eab_kid cannot be used when importing an account"), nil
+	}
+	if caBundle != "" {
+		if _, err := getCertPool(caBundle); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+	if httpProxy != "" {
+		// url.Parse accepts values like "proxy:3128" that only fail when
+		// the CA is contacted
+		if u, err := url.Parse(httpProxy); err != nil || u.Scheme == "" || u.Host == "" {
+			return logical.ErrorResponse("http_proxy must be an URL with a scheme and a host, e.g. http://proxy:3128"), nil
+		}
+	}
+	if httpTimeout < 0 {
+		return logical.ErrorResponse("http_timeout must be positive"), nil
+	}
+	if err := validateChallengePreference(challengePreference); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if propagationTimeout < 0 || pollingInterval < 0 || txtTTL < 0 {
+		return logical.ErrorResponse("propagation_timeout, polling_interval and txt_ttl must be positive"), nil
+	}
+	if propagationTimeout > 0 && pollingInterval > propagationTimeout {
+		return logical.ErrorResponse("polling_interval must be less than propagation_timeout"), nil
+	}
+	if txtTTL > 0 {
+		for _, name := range providerNames {
+			if err := checkTTLSupport(name); err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+		}
+	}
+	if certificatesPerDomainLimit < 0 || failedValidationsLimit < 0 {
+		return logical.ErrorResponse("certificates_per_domain_limit and failed_validations_limit must be positive"), nil
+	}
 
-	var update bool
+	var update, existing bool
 	user, err := getAccount(ctx, req.Storage, req.Path)
 	if err != nil {
 		return nil, err
 	}
 
-	if user == nil {
+	if user == nil && privateKeyPEM != "" {
+		b.Logger().Info("Importing key pair for existing account")
+		privateKey, err := parsePrivateKey(privateKeyPEM)
+		if err != nil {
+			return logical.ErrorResponse("Failed to parse private_key: %s", err), nil
+		}
+		keyType, err := getKeyTypeName(privateKey)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		if k, ok := data.GetOk("key_type"); ok && k.(string) != keyType {
+			return logical.ErrorResponse("key_type does not match the type of private_key"), nil
+		}
+
+		existing = true
+		user = &account{
+			ServerURL: serverURL,
+			KeyType:   keyType,
+			Key:       privateKey,
+		}
+	} else if user == nil {
 		b.Logger().Info("Generating key pair for new account")
 		keyType, err := getKeyType(data.Get("key_type").(string))
 		if err != nil {
@@ -143,19 +521,50 @@ func (b *backend) accountWrite(ctx context.Context, req *logical.Request, data *
 		if serverURL != user.ServerURL {
 			return logical.ErrorResponse("Cannot update server_url"), nil
 		}
-		if data.Get("key_type").(string) != user.KeyType {
+		// key_type defaults to EC256 so it is only checked when given, the
+		// key may have been rotated or imported with another type
+		if k, ok := data.GetOk("key_type"); ok && k.(string) != user.KeyType {
 			return logical.ErrorResponse("Cannot update key_type"), nil
 		}
+		if eabKeyID != "" {
+			return logical.ErrorResponse("Cannot set an external account binding on an existing account"), nil
+		}
+		if privateKeyPEM != "" {
+			return logical.ErrorResponse("Cannot update private_key"), nil
+		}
 	}
 
+	user.ServerURLAlias = serverURLAlias
 	user.Email = contact
 	user.Provider = provider
-	user.ProviderConfiguration = providerConfiguration
+	user.DNSProvider = dnsProvider
+	user.DNSZoneProviders = dnsZoneProviders
+	// The provider configuration is write-only so we keep the current one
+	// when it is not given during an update
+	if _, ok := data.GetOk("provider_configuration"); ok || !update {
+		user.ProviderConfiguration = providerConfiguration
+	}
 	user.EnableHTTP01 = enableHTTP01
 	user.EnableTLSALPN01 = enableTLSALPN01
 	user.TermsOfServiceAgreed = termsOfServiceAgreed
 	user.DNSResolvers = dnsResolvers
+	user.PropagationTimeout = propagationTimeout
+	user.PollingInterval = pollingInterval
+	user.TXTTTL = txtTTL
 	user.IgnoreDNSPropagation = ignoreDNSPropagation
+	user.CABundle = caBundle
+	user.HTTPProxy = httpProxy
+	user.HTTPTimeout = httpTimeout
+	user.UserAgent = userAgent
+	user.CertificatesPerDomainLimit = certificatesPerDomainLimit
+	user.FailedValidationsLimit = failedValidationsLimit
+	user.RateLimitAction = rateLimitAction
+	user.ChallengePreference = challengePreference
+	for _, t := range challengePreference {
+		if !user.challengeEnabled(t) {
+			return logical.ErrorResponse("%s is in challenge_preference but is not enabled on the account", t), nil
+		}
+	}
 
 	client, err := user.getClient()
 	if err != nil {
@@ -169,6 +578,25 @@ func (b *backend) accountWrite(ctx context.Context, req *logical.Request, data *
 	if update {
 		b.Logger().Info("Updating account")
 		reg, err = client.Registration.UpdateRegistration(options)
+	} else if existing {
+		b.Logger().Info("Looking up existing account")
+		reg, err = client.Registration.ResolveAccountByKey()
+		if err == nil {
+			// Make sure the contact known by the CA matches the one we store
+			user.Registration = reg
+			if client, err = user.getClient(); err != nil {
+				return nil, err
+			}
+			reg, err = client.Registration.UpdateRegistration(options)
+		}
+	} else if eabKeyID != "" {
+		b.Logger().Info("Registring new account with external account binding")
+		reg, err = client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+			TermsOfServiceAgreed: termsOfServiceAgreed,
+			Kid:                  eabKeyID,
+			HmacEncoded:          eabHMACKey,
+		})
+		user.EABKeyID = eabKeyID
 	} else {
 		b.Logger().Info("Registring new account")
 		reg, err = client.Registration.Register(options)
@@ -179,6 +607,14 @@ func (b *backend) accountWrite(ctx context.Context, req *logical.Request, data *
 	}
 	user.Registration = reg
 
+	// Changes of the terms of service must be explicitly agreed to using
+	// accounts/:account/agree-terms so we only record the URL the first time
+	if !termsOfServiceAgreed {
+		user.TermsOfServiceURL = ""
+	} else if user.TermsOfServiceURL == "" {
+		user.TermsOfServiceURL = client.GetToSURL()
+	}
+
 	if err != nil {
 		return nil, errwrap.Wrapf("Failed to create storage entry: {{err}}", err)
 	}
@@ -188,6 +624,12 @@ func (b *backend) accountWrite(ctx context.Context, req *logical.Request, data *
 		return nil, err
 	}
 
+	// The CA has just been contacted anyway, having its directory in the
+	// cache lets the response tell whether its terms of service changed
+	if _, _, err = b.directories.Get(user, false); err != nil {
+		b.Logger().Warn("Failed to fetch the directory of the ACME CA", "server_url", serverURL, "error", err)
+	}
+
 	return b.accountRead(ctx, req, data)
 }
 
@@ -200,25 +642,127 @@ func (b *backend) accountRead(ctx context.Context, req *logical.Request, data *f
 		return logical.ErrorResponse("This account does not exists"), nil
 	}
 
+	roles, err := getAccountRoles(ctx, req.Storage, data.Get("account").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	// The state is unknown until the directory has been fetched
+	var termsOfServiceChanged interface{}
+	if changed, known := b.termsOfServiceChanged(a); known {
+		termsOfServiceChanged = changed
+	}
+	providerConfiguration, err := b.redactProviderConfiguration(ctx, a.ProviderConfiguration)
+	if err != nil {
+		return nil, err
+	}
+
+	challengePreference := a.ChallengePreference
+	if challengePreference == nil {
+		challengePreference = []string{}
+	}
+
 	return &logical.Response{
 		Data: map[string]interface{}{
-			"server_url":              a.ServerURL,
-			"registration_uri":        a.Registration.URI,
-			"contact":                 a.GetEmail(),
-			"terms_of_service_agreed": a.TermsOfServiceAgreed,
-			"key_type":                a.KeyType,
-			"provider":                a.Provider,
-			"provider_configuration":  a.ProviderConfiguration,
-			"enable_http_01":          a.EnableHTTP01,
-			"enable_tls_alpn_01":      a.EnableTLSALPN01,
-			"dns_resolvers":           a.DNSResolvers,
-			"ignore_dns_propagation":  a.IgnoreDNSPropagation,
+			"server_url":                    a.ServerURL,
+			"server_url_alias":              a.ServerURLAlias,
+			"registration_uri":              a.Registration.URI,
+			"contact":                       a.GetEmail(),
+			"terms_of_service_agreed":       a.TermsOfServiceAgreed,
+			"terms_of_service_url":          a.TermsOfServiceURL,
+			"terms_of_service_changed":      termsOfServiceChanged,
+			"key_type":                      a.KeyType,
+			"provider":                      a.Provider,
+			"provider_configuration":        providerConfiguration,
+			"dns_provider":                  a.DNSProvider,
+			"dns_zone_providers":            a.DNSZoneProviders,
+			"enable_http_01":                a.EnableHTTP01,
+			"enable_tls_alpn_01":            a.EnableTLSALPN01,
+			"dns_resolvers":                 a.DNSResolvers,
+			"propagation_timeout":           a.PropagationTimeout,
+			"polling_interval":              a.PollingInterval,
+			"txt_ttl":                       a.TXTTTL,
+			"ignore_dns_propagation":        a.IgnoreDNSPropagation,
+			"eab_kid":                       a.EABKeyID,
+			"external_account_bound":        a.EABKeyID != "",
+			"ca_bundle":                     a.CABundle,
+			"http_proxy":                    a.HTTPProxy,
+			"http_timeout":                  a.HTTPTimeout,
+			"user_agent":                    a.UserAgent,
+			"certificates_per_domain_limit": a.CertificatesPerDomainLimit,
+			"failed_validations_limit":      a.FailedValidationsLimit,
+			"rate_limit_action":             a.RateLimitAction,
+			"challenge_preference":          challengePreference,
+			"roles":                         roles,
 		},
 	}, nil
 }
 
-func (b *backend) accountDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	a, err := getAccount(ctx, req.Storage, req.Path)
+// termsOfServiceChanged returns whether the CA now advertises different terms
+// of service than the ones the account agreed to. known is false while the
+// directory of the CA is not in the cache.
+func (b *backend) termsOfServiceChanged(a *account) (changed, known bool) {
+	if a.TermsOfServiceURL == "" {
+		return false, true
+	}
+
+	// This is called on each read and certificate request so the CA is
+	// never contacted here, the check is skipped until the directory has
+	// been fetched in the background
+	dir := b.directories.Cached(a)
+	if dir == nil {
+		return false, false
+	}
+
+	current := dir.Meta.TermsOfService
+	changed = current != "" && current != a.TermsOfServiceURL
+	if b.termsOfServiceWarnings.update(a.ServerURL, a.TermsOfServiceURL, current, changed) {
+		b.Logger().Warn("The terms of service of the ACME CA changed", "server_url", a.ServerURL, "agreed", a.TermsOfServiceURL, "current", current)
+	}
+	return changed, true
+}
+
+// termsOfServiceWarnings remembers the changes of the terms of service that
+// have already been logged so they are only logged once
+type termsOfServiceWarnings struct {
+	sync.Mutex
+	warned map[termsOfServiceKey]string
+}
+
+// termsOfServiceKey identifies the accounts of a CA that agreed to the same
+// terms of service
+type termsOfServiceKey struct {
+	serverURL string
+	agreed    string
+}
+
+func newTermsOfServiceWarnings() *termsOfServiceWarnings {
+	return &termsOfServiceWarnings{
+		warned: map[termsOfServiceKey]string{},
+	}
+}
+
+// update records the state of the terms of service for the accounts of
+// serverURL that agreed to agreed and returns whether it must be logged
+func (w *termsOfServiceWarnings) update(serverURL, agreed, current string, changed bool) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	key := termsOfServiceKey{serverURL: serverURL, agreed: agreed}
+	if !changed {
+		delete(w.warned, key)
+		return false
+	}
+	if w.warned[key] == current {
+		return false
+	}
+	w.warned[key] = current
+	return true
+}
+
+func (b *backend) accountAgreeTerms(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	path := "accounts/" + data.Get("account").(string)
+	a, err := getAccount(ctx, req.Storage, path)
 	if err != nil {
 		return nil, err
 	}
@@ -231,20 +775,587 @@ func (b *backend) accountDelete(ctx context.Context, req *logical.Request, data
 		return nil, errwrap.Wrapf("Failed to instanciate new client: {{err}}", err)
 	}
 
-	if err = client.Registration.DeleteRegistration(); err != nil {
-		return nil, errwrap.Wrapf("Failed to deactivate registration: {{err}}", err)
+	b.Logger().Info("Agreeing to the terms of service", "account", path, "terms_of_service", client.GetToSURL())
+	reg, err := client.Registration.UpdateRegistration(registration.RegisterOptions{
+		TermsOfServiceAgreed: true,
+	})
+	if err != nil {
+		return logical.ErrorResponse("Failed to update registration: %s", err), nil
 	}
 
-	err = req.Storage.Delete(ctx, req.Path)
+	a.Registration = reg
+	a.TermsOfServiceAgreed = true
+	a.TermsOfServiceURL = client.GetToSURL()
+	if err = a.save(ctx, req.Storage, path, a.ServerURL); err != nil {
+		return nil, err
+	}
 
-	return nil, err
+	req.Path = path
+	return b.accountRead(ctx, req, data)
 }
 
-func (b *backend) accountList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	entries, err := req.Storage.List(ctx, "accounts/")
-	if err != nil {
+func (b *backend) accountMigrate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := data.Validate(); err != nil {
 		return nil, err
 	}
 
-	return logical.ListResponse(entries), nil
+	path := "accounts/" + data.Get("account").(string)
+	a, err := getAccount(ctx, req.Storage, path)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return logical.ErrorResponse("This account does not exists"), nil
+	}
+
+	serverURL, serverURLAlias, err := resolveServerURL(data.Get("server_url").(string))
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if serverURL == a.ServerURL {
+		return logical.ErrorResponse("This account already uses this server_url"), nil
+	}
+
+	termsOfServiceAgreed := data.Get("terms_of_service_agreed").(bool)
+	eabKeyID := data.Get("eab_kid").(string)
+	eabHMACKey := data.Get("eab_hmac_key").(string)
+	if (eabKeyID == "") != (eabHMACKey == "") {
+		return logical.ErrorResponse("eab_kid and eab_hmac_key must be set together"), nil
+	}
+
+	// We work on a copy so the stored account is left untouched if the
+	// registration fails
+	migrated := *a
+	migrated.ServerURL = serverURL
+	migrated.ServerURLAlias = serverURLAlias
+	migrated.Registration = nil
+	migrated.TermsOfServiceAgreed = termsOfServiceAgreed
+	migrated.TermsOfServiceURL = ""
+	migrated.EABKeyID = eabKeyID
+
+	keyTypeName := data.Get("key_type").(string)
+	if data.Get("regenerate_key").(bool) {
+		if keyTypeName == "" {
+			keyTypeName = a.KeyType
+		}
+		keyType, err := getKeyType(keyTypeName)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		b.Logger().Info("Generating new key pair for account", "account", path)
+		if migrated.Key, err = certcrypto.GeneratePrivateKey(keyType); err != nil {
+			return nil, errwrap.Wrapf("Failed to generate account key pair: {{err}}", err)
+		}
+		migrated.KeyType = keyTypeName
+	} else if keyTypeName != "" && keyTypeName != a.KeyType {
+		return logical.ErrorResponse("key_type can only be changed when regenerate_key is set"), nil
+	}
+
+	client, err := migrated.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	b.Logger().Info("Registring account on new server", "account", path, "server_url", serverURL)
+	var reg *registration.Resource
+	if eabKeyID != "" {
+		reg, err = client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+			TermsOfServiceAgreed: termsOfServiceAgreed,
+			Kid:                  eabKeyID,
+			HmacEncoded:          eabHMACKey,
+		})
+	} else {
+		reg, err = client.Registration.Register(registration.RegisterOptions{
+			TermsOfServiceAgreed: termsOfServiceAgreed,
+		})
+	}
+	if err != nil {
+		return logical.ErrorResponse("Failed to register account: %s", err), nil
+	}
+
+	migrated.Registration = reg
+	if termsOfServiceAgreed {
+		migrated.TermsOfServiceURL = client.GetToSURL()
+	}
+
+	b.Logger().Info("Saving account")
+	if err = migrated.save(ctx, req.Storage, path, serverURL); err != nil {
+		return nil, err
+	}
+
+	// The cached certificates have been issued by the previous CA. The
+	// account has already been migrated so failing now would be misleading.
+	b.cache.Lock()
+	err = b.cache.DeleteAccount(ctx, req.Storage, data.Get("account").(string))
+	b.cache.Unlock()
+	if err != nil {
+		b.Logger().Error("Failed to remove the cached certificates of the migrated account, the cache should be cleared", "account", path, "error", err)
+	}
+
+	req.Path = path
+	return b.accountRead(ctx, req, data)
+}
+
+func (b *backend) accountDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if data.Get("force").(bool) {
+		// The account is not decoded so that it can be removed even when its
+		// entry is broken, e.g. when its key is missing or when it has been
+		// written by a newer version of the plugin
+		exists := false
+		for _, path := range []string{req.Path, accountKeyPath(req.Path)} {
+			entry, err := req.Storage.Get(ctx, path)
+			if err != nil {
+				return nil, err
+			}
+			exists = exists || entry != nil
+		}
+		if !exists {
+			return logical.ErrorResponse("This account does not exists"), nil
+		}
+	} else {
+		a, err := getAccount(ctx, req.Storage, req.Path)
+		if err != nil {
+			return nil, err
+		}
+		if a == nil {
+			return logical.ErrorResponse("This account does not exists"), nil
+		}
+
+		roles, err := getAccountRoles(ctx, req.Storage, data.Get("account").(string))
+		if err != nil {
+			return nil, err
+		}
+		if len(roles) > 0 {
+			return logical.ErrorResponse("This account is used by roles %s, use force=true to delete it anyway", strings.Join(roles, ", ")), nil
+		}
+
+		// Removing an account that is still valid would leave it registered
+		// at the CA without any way to use it
+		if a.Registration.Body.Status != legoacme.StatusDeactivated {
+			return logical.ErrorResponse("This account is still active, deactivate it first or use force=true"), nil
+		}
+	}
+
+	if err := b.ledger.Clear(ctx, req.Storage, data.Get("account").(string)); err != nil {
+		return nil, err
+	}
+	if err := b.ledger.DeleteStats(ctx, req.Storage, data.Get("account").(string)); err != nil {
+		return nil, err
+	}
+
+	if err := req.Storage.Delete(ctx, req.Path); err != nil {
+		return nil, err
+	}
+
+	return nil, req.Storage.Delete(ctx, accountKeyPath(req.Path))
+}
+
+func (b *backend) accountDeactivate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	path := "accounts/" + data.Get("account").(string)
+	a, err := getAccount(ctx, req.Storage, path)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return logical.ErrorResponse("This account does not exists"), nil
+	}
+
+	client, err := a.getClient()
+	if err != nil {
+		return nil, errwrap.Wrapf("Failed to instanciate new client: {{err}}", err)
+	}
+
+	if err = client.Registration.DeleteRegistration(); err != nil {
+		return logical.ErrorResponse("Failed to deactivate registration: %s", err), nil
+	}
+
+	a.Registration.Body.Status = legoacme.StatusDeactivated
+	if err = a.save(ctx, req.Storage, path, a.ServerURL); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *backend) accountDirectory(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	path := "accounts/" + data.Get("account").(string)
+	a, err := getAccount(ctx, req.Storage, path)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return logical.ErrorResponse("This account does not exists"), nil
+	}
+
+	dir, fetchedAt, err := b.directories.Get(a, data.Get("refresh").(bool))
+	if err != nil {
+		return logical.ErrorResponse("Failed to get directory: %s", err), nil
+	}
+
+	caaIdentities := dir.Meta.CaaIdentities
+	if caaIdentities == nil {
+		caaIdentities = []string{}
+	}
+	profiles := dir.Meta.Profiles
+	if profiles == nil {
+		profiles = map[string]string{}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"server_url":                a.ServerURL,
+			"fetched_at":                fetchedAt.Format(time.RFC3339),
+			"new_nonce":                 dir.NewNonceURL,
+			"new_account":               dir.NewAccountURL,
+			"new_order":                 dir.NewOrderURL,
+			"new_authz":                 dir.NewAuthzURL,
+			"revoke_cert":               dir.RevokeCertURL,
+			"key_change":                dir.KeyChangeURL,
+			"terms_of_service":          dir.Meta.TermsOfService,
+			"website":                   dir.Meta.Website,
+			"caa_identities":            caaIdentities,
+			"external_account_required": dir.Meta.ExternalAccountRequired,
+			"profiles":                  profiles,
+		},
+	}, nil
+}
+
+func (b *backend) accountStatus(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	path := "accounts/" + data.Get("account").(string)
+	a, err := getAccount(ctx, req.Storage, path)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return logical.ErrorResponse("This account does not exists"), nil
+	}
+
+	client, err := a.getClient()
+	if err != nil {
+		return nil, errwrap.Wrapf("Failed to instanciate new client: {{err}}", err)
+	}
+
+	var problemDetail string
+	reg, err := client.Registration.QueryRegistration()
+	// Only the registration returned by the CA is saved, never a status
+	// deduced from its error
+	save := req.Operation == logical.UpdateOperation && err == nil
+	if err != nil {
+		// The CA refuses to answer for the accounts it does not know or that
+		// are not valid anymore, this is what we want to report
+		status, detail, ok := getAccountProblemStatus(err)
+		if !ok {
+			return logical.ErrorResponse("Failed to query registration: %s", err), nil
+		}
+		reg = &registration.Resource{
+			URI:  a.Registration.URI,
+			Body: a.Registration.Body,
+		}
+		reg.Body.Status = status
+		problemDetail = detail
+	}
+
+	// Read requests may not be allowed to write to the storage, e.g. on
+	// performance standbys
+	if save {
+		a.Registration = reg
+		if err = a.save(ctx, req.Storage, path, a.ServerURL); err != nil {
+			return nil, err
+		}
+	}
+
+	contact := reg.Body.Contact
+	if contact == nil {
+		contact = []string{}
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"registration_uri":        reg.URI,
+			"status":                  reg.Body.Status,
+			"contact":                 contact,
+			"terms_of_service_agreed": reg.Body.TermsOfServiceAgreed,
+			"orders":                  reg.Body.Orders,
+		},
+	}
+	if problemDetail != "" {
+		resp.Data["error"] = problemDetail
+	}
+	return resp, nil
+}
+
+// getAccountProblemStatus returns the status to report for an account when
+// the CA refused to return it with err. The CA answers with an unauthorized
+// problem once an account has been deactivated or revoked, and with an
+// accountDoesNotExist one when it does not know it. As unauthorized is also
+// used for other reasons, e.g. when the request is not signed by the key of
+// the account, it is only reported as a status when the detail names it.
+func getAccountProblemStatus(err error) (status, detail string, ok bool) {
+	var problem *legoacme.ProblemDetails
+	if !errors.As(err, &problem) {
+		return "", "", false
+	}
+
+	switch problem.Type {
+	case unauthorizedErrorType:
+		for _, status := range []string{legoacme.StatusDeactivated, legoacme.StatusRevoked} {
+			if strings.Contains(strings.ToLower(problem.Detail), status) {
+				return status, problem.Detail, true
+			}
+		}
+		return "", "", false
+	case accountDoesNotExistErrorType:
+		return accountStatusDoesNotExist, problem.Detail, true
+	default:
+		return "", "", false
+	}
+}
+
+func (b *backend) accountLedgerRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("account").(string)
+	a, err := getAccount(ctx, req.Storage, "accounts/"+name)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return logical.ErrorResponse("This account does not exists"), nil
+	}
+
+	domains, err := b.ledger.List(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	ledger := map[string]interface{}{}
+	for _, domain := range domains {
+		entry, err := b.ledger.Read(ctx, req.Storage, name, domain)
+		if err != nil {
+			return nil, err
+		}
+
+		events := make([]map[string]interface{}, 0, len(entry.Events))
+		for _, event := range entry.Events {
+			e := map[string]interface{}{
+				"time":  event.Time.Format(time.RFC3339),
+				"type":  event.Type,
+				"names": event.Names,
+			}
+			if event.Error != "" {
+				e["error"] = event.Error
+			}
+			events = append(events, e)
+		}
+
+		ledger[domain] = map[string]interface{}{
+			"orders":             entry.count(ledgerEventOrder, now.Add(-certificatesWindow)),
+			"certificates":       entry.count(ledgerEventSuccess, now.Add(-certificatesWindow)),
+			"failed_validations": entry.count(ledgerEventFailure, now.Add(-failedValidationsWindow)),
+			"events":             events,
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"certificates_per_domain_limit": a.CertificatesPerDomainLimit,
+			"failed_validations_limit":      a.FailedValidationsLimit,
+			"rate_limit_action":             a.RateLimitAction,
+			"domains":                       ledger,
+		},
+	}, nil
+}
+
+func (b *backend) accountLedgerDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	return nil, b.ledger.Clear(ctx, req.Storage, data.Get("account").(string))
+}
+
+// redactProviderConfiguration replaces the values of the provider
+// configuration by a fingerprint so they can be compared without being
+// disclosed. The fingerprint is salted so that the values cannot be guessed
+// offline.
+func (b *backend) redactProviderConfiguration(ctx context.Context, c map[string]string) (map[string]string, error) {
+	s, err := b.Salt(ctx)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to get the salt: {{err}}", err)
+	}
+
+	redacted := make(map[string]string, len(c))
+	for k, v := range c {
+		redacted[k] = s.GetIdentifiedHMAC(v)
+	}
+	return redacted, nil
+}
+
+func (b *backend) accountProviderConfigurationWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := data.Validate(); err != nil {
+		return nil, err
+	}
+
+	path := "accounts/" + data.Get("account").(string)
+	a, err := getAccount(ctx, req.Storage, path)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return logical.ErrorResponse("This account does not exists"), nil
+	}
+
+	a.ProviderConfiguration[data.Get("key").(string)] = data.Get("value").(string)
+	if err = a.save(ctx, req.Storage, path, a.ServerURL); err != nil {
+		return nil, err
+	}
+
+	req.Path = path
+	return b.accountRead(ctx, req, data)
+}
+
+func (b *backend) accountProviderConfigurationDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	path := "accounts/" + data.Get("account").(string)
+	a, err := getAccount(ctx, req.Storage, path)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return logical.ErrorResponse("This account does not exists"), nil
+	}
+
+	delete(a.ProviderConfiguration, data.Get("key").(string))
+	if err = a.save(ctx, req.Storage, path, a.ServerURL); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *backend) accountRotateKey(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := data.Validate(); err != nil {
+		return nil, err
+	}
+
+	path := "accounts/" + data.Get("account").(string)
+	a, err := getAccount(ctx, req.Storage, path)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return logical.ErrorResponse("This account does not exists"), nil
+	}
+
+	keyTypeName := data.Get("key_type").(string)
+	if keyTypeName == "" {
+		keyTypeName = a.KeyType
+	}
+	keyType, err := getKeyType(keyTypeName)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	b.Logger().Info("Generating new key pair for account", "account", path)
+	newKey, err := certcrypto.GeneratePrivateKey(keyType)
+	if err != nil {
+		return nil, errwrap.Wrapf("Failed to generate account key pair: {{err}}", err)
+	}
+
+	client, err := newACMEClient(a)
+	if err != nil {
+		return nil, err
+	}
+	if err = client.keyChange(a, newKey); err != nil {
+		return logical.ErrorResponse("Failed to change account key: %s", err), nil
+	}
+
+	// The ACME server now only accepts the new key, we must save it right away
+	a.Key = newKey
+	a.KeyType = keyTypeName
+	b.Logger().Info("Saving account")
+	if err = a.save(ctx, req.Storage, path, a.ServerURL); err != nil {
+		return nil, err
+	}
+
+	req.Path = path
+	return b.accountRead(ctx, req, data)
+}
+
+func (b *backend) accountList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	entries, err := req.Storage.List(ctx, "accounts/")
+	if err != nil {
+		return nil, err
+	}
+
+	// We look at the roles only once instead of calling getAccountRoles for
+	// each account
+	roles := map[string][]string{}
+	roleNames, err := req.Storage.List(ctx, "roles/")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range roleNames {
+		r, err := getRole(ctx, req.Storage, "roles/"+name)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			roles[r.Account] = append(roles[r.Account], name)
+		}
+	}
+
+	keyInfo := map[string]interface{}{}
+	for _, name := range entries {
+		accountRoles := roles[name]
+		if accountRoles == nil {
+			accountRoles = []string{}
+		}
+
+		// Only the settings are decoded, the private key is not needed here.
+		// A broken account is reported instead of failing the whole list.
+		var e accountEntry
+		found, err := accountSchema.decode(ctx, req.Storage, "accounts/"+name, &e)
+		if err != nil {
+			keyInfo[name] = map[string]interface{}{
+				"error": err.Error(),
+				"roles": accountRoles,
+			}
+			continue
+		}
+		if !found {
+			continue
+		}
+
+		stats, err := b.ledger.Stats(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+
+		provider := e.Provider
+		if e.DNSProvider != "" {
+			provider = e.DNSProvider
+		}
+		var status string
+		if e.Registration != nil {
+			status = e.Registration.Status
+		}
+
+		keyInfo[name] = map[string]interface{}{
+			"server_url":          e.ServerURL,
+			"contact":             e.Contact,
+			"provider":            provider,
+			"status":              status,
+			"certificates_issued": stats.CertificatesIssued,
+			"last_success":        formatTime(stats.LastSuccess),
+			"last_failure":        formatTime(stats.LastFailure),
+			"last_error":          stats.LastError,
+			"roles":               accountRoles,
+		}
+	}
+
+	return logical.ListResponseWithInfo(entries, keyInfo), nil
+}
+
+// formatTime returns t in the RFC 3339 format, or an empty string when it is
+// not set
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
 }
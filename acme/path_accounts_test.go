@@ -1,8 +1,21 @@
 package acme
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/go-acme/lego/v3/certcrypto"
+	"github.com/go-acme/lego/v3/registration"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/stretchr/testify/require"
 )
@@ -18,16 +31,35 @@ func TestAccounts(t *testing.T) {
 		"dns_resolvers":           []string{"127.0.0.1:8053"},
 	}
 	expected := map[string]interface{}{
-		"contact":                 "remi@lenstra.fr",
-		"server_url":              "https://localhost:14000/dir",
-		"terms_of_service_agreed": true,
-		"provider":                "exec",
-		"provider_configuration":  map[string]string{},
-		"key_type":                "EC256",
-		"enable_http_01":          false,
-		"enable_tls_alpn_01":      false,
-		"dns_resolvers":           []string{"127.0.0.1:8053"},
-		"ignore_dns_propagation":  false,
+		"contact":                       "remi@lenstra.fr",
+		"server_url":                    "https://localhost:14000/dir",
+		"server_url_alias":              "",
+		"terms_of_service_agreed":       true,
+		"terms_of_service_url":          "data:text/plain,Do%20what%20thou%20wilt",
+		"terms_of_service_changed":      false,
+		"provider":                      "exec",
+		"provider_configuration":        map[string]string{},
+		"dns_provider":                  "",
+		"dns_zone_providers":            map[string]string{},
+		"key_type":                      "EC256",
+		"enable_http_01":                false,
+		"enable_tls_alpn_01":            false,
+		"dns_resolvers":                 []string{"127.0.0.1:8053"},
+		"propagation_timeout":           0,
+		"polling_interval":              0,
+		"txt_ttl":                       0,
+		"ignore_dns_propagation":        false,
+		"eab_kid":                       "",
+		"external_account_bound":        false,
+		"ca_bundle":                     "",
+		"http_proxy":                    "",
+		"http_timeout":                  0,
+		"user_agent":                    "",
+		"certificates_per_domain_limit": 0,
+		"failed_validations_limit":      0,
+		"rate_limit_action":             "warn",
+		"challenge_preference":          []string{},
+		"roles":                         []string{},
 	}
 
 	testCases := []struct {
@@ -86,7 +118,12 @@ func TestAccounts(t *testing.T) {
 		delete(resp.Data, "registration_uri")
 		require.Equal(t, expected, resp.Data)
 
-		// Delete account
+		// Deactivate and delete account
+		makeRequest(t, b, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "accounts/lenstra/deactivate",
+			Storage:   config.StorageView,
+		}, "")
 		req.Operation = logical.DeleteOperation
 		makeRequest(t, b, req, "")
 	}
@@ -141,11 +178,48 @@ func TestDeleteAccount(t *testing.T) {
 	makeRequest(t, b, req, "")
 
 	req.Operation = logical.DeleteOperation
+	makeRequest(t, b, req, "This account is still active, deactivate it first or use force=true")
+
+	deactivateReq := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/lenstra/deactivate",
+		Storage:   config.StorageView,
+	}
+	makeRequest(t, b, deactivateReq, "")
+
+	statusResp := makeRequest(t, b, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "accounts/lenstra/status",
+		Storage:   config.StorageView,
+	}, "")
+	require.Equal(t, "deactivated", statusResp.Data["status"])
+	require.NotEmpty(t, statusResp.Data["error"])
+
 	makeRequest(t, b, req, "")
 	makeRequest(t, b, req, "This account does not exists")
 
 	req.Operation = logical.ReadOperation
 	makeRequest(t, b, req, "This account does not exists")
+
+	// Forcing the deletion only removes the local state
+	req.Operation = logical.CreateOperation
+	makeRequest(t, b, req, "")
+
+	// The private key is stored apart from the account so it can be seal wrapped
+	keyEntry, err := config.StorageView.Get(context.Background(), "account_keys/lenstra")
+	require.NoError(t, err)
+	require.NotNil(t, keyEntry)
+	require.Contains(t, b.SpecialPaths().SealWrapStorage, "account_keys/")
+
+	req.Operation = logical.DeleteOperation
+	req.Data = map[string]interface{}{"force": true}
+	makeRequest(t, b, req, "")
+	req.Operation = logical.ReadOperation
+	makeRequest(t, b, req, "This account does not exists")
+
+	keyEntry, err = config.StorageView.Get(context.Background(), "account_keys/lenstra")
+	require.NoError(t, err)
+	require.Nil(t, keyEntry)
 }
 
 func TestListAccounts(t *testing.T) {
@@ -175,5 +249,528 @@ func TestListAccounts(t *testing.T) {
 	listResp = makeRequest(t, b, listReq, "")
 	require.Equal(t, map[string]interface{}{
 		"keys": []string{"lenstra"},
+		"key_info": map[string]interface{}{
+			"lenstra": map[string]interface{}{
+				"server_url":          "https://localhost:14000/dir",
+				"contact":             "remi@lenstra.fr",
+				"provider":            "exec",
+				"status":              "valid",
+				"certificates_issued": 0,
+				"last_success":        "",
+				"last_failure":        "",
+				"last_error":          "",
+				"roles":               []string{},
+			},
+		},
 	}, listResp.Data)
 }
+
+func TestAccountExternalAccountBinding(t *testing.T) {
+	config, b := getTestConfig(t)
+
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "accounts/lenstra",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"server_url":              "https://localhost:14000/dir",
+			"contact":                 "remi@lenstra.fr",
+			"terms_of_service_agreed": true,
+			"eab_kid":                 "kid-1",
+		},
+	}
+	makeRequest(t, b, req, "eab_kid and eab_hmac_key must be set together")
+
+	delete(req.Data, "eab_kid")
+	resp := makeRequest(t, b, req, "")
+	require.Equal(t, false, resp.Data["external_account_bound"])
+	require.NotContains(t, resp.Data, "eab_hmac_key")
+
+	req.Operation = logical.UpdateOperation
+	req.Data["eab_kid"] = "kid-1"
+	req.Data["eab_hmac_key"] = "zWNDZM6eQGHWpSRTPal5eIUYFTu7EajVIoguysqZ9wG44nMEtx3MUAsUDkMTQ12W"
+	makeRequest(t, b, req, "Cannot set an external account binding on an existing account")
+}
+
+func TestRotateAccountKey(t *testing.T) {
+	config, b := getTestConfig(t)
+	createAccount(t, b, config.StorageView)
+
+	readReq := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "accounts/lenstra",
+		Storage:   config.StorageView,
+	}
+	before := makeRequest(t, b, readReq, "")
+
+	rotateReq := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/lenstra/rotate-key",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"key_type": "RSA2048",
+		},
+	}
+	after := makeRequest(t, b, rotateReq, "")
+	require.Equal(t, "RSA2048", after.Data["key_type"])
+	require.Equal(t, before.Data["registration_uri"], after.Data["registration_uri"])
+
+	// The account can still be updated without giving its key type
+	updateReq := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/lenstra",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"server_url":              "https://localhost:14000/dir",
+			"contact":                 "remi@lenstra.fr",
+			"terms_of_service_agreed": true,
+			"provider":                "exec",
+			"dns_resolvers":           []string{"127.0.0.1:8053"},
+			"ignore_dns_propagation":  true,
+		},
+	}
+	makeRequest(t, b, updateReq, "")
+	updateReq.Data["key_type"] = "EC256"
+	makeRequest(t, b, updateReq, "Cannot update key_type")
+
+	// The account must still be usable with the new key
+	createRole(t, b, config.StorageView)
+	checkCreatingCerts(t, b, config.StorageView)
+
+	rotateReq.Path = "accounts/unknown/rotate-key"
+	makeRequest(t, b, rotateReq, "This account does not exists")
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	ecKey, err := certcrypto.GeneratePrivateKey(certcrypto.EC384)
+	require.NoError(t, err)
+	rsaKey, err := certcrypto.GeneratePrivateKey(certcrypto.RSA2048)
+	require.NoError(t, err)
+
+	sec1, err := x509.MarshalECPrivateKey(ecKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		block   *pem.Block
+		keyType string
+	}{
+		{&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}, "EC384"},
+		{&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey.(*rsa.PrivateKey))}, "RSA2048"},
+		{&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}, "RSA2048"},
+	}
+	for _, tc := range testCases {
+		key, err := parsePrivateKey(string(pem.EncodeToMemory(tc.block)))
+		require.NoError(t, err)
+		keyType, err := getKeyTypeName(key)
+		require.NoError(t, err)
+		require.Equal(t, tc.keyType, keyType)
+	}
+
+	_, err = parsePrivateKey("foo")
+	require.EqualError(t, err, "failed to decode PEM block")
+}
+
+func TestImportAccount(t *testing.T) {
+	config, b := getTestConfig(t)
+
+	// Register an account outside of Vault first
+	key, err := certcrypto.GeneratePrivateKey(certcrypto.EC256)
+	require.NoError(t, err)
+	a := &account{
+		Email:     "remi@lenstra.fr",
+		Key:       key,
+		ServerURL: "https://localhost:14000/dir",
+	}
+	client, err := a.getClient()
+	require.NoError(t, err)
+	reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	require.NoError(t, err)
+
+	sec1, err := x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "accounts/lenstra",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"server_url":              "https://localhost:14000/dir",
+			"contact":                 "remi@lenstra.fr",
+			"terms_of_service_agreed": true,
+			"key_type":                "RSA2048",
+			"private_key":             string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})),
+		},
+	}
+	makeRequest(t, b, req, "key_type does not match the type of private_key")
+
+	delete(req.Data, "key_type")
+	resp := makeRequest(t, b, req, "")
+	require.Equal(t, reg.URI, resp.Data["registration_uri"])
+	require.Equal(t, "EC256", resp.Data["key_type"])
+	require.NotContains(t, resp.Data, "private_key")
+
+	req.Operation = logical.UpdateOperation
+	makeRequest(t, b, req, "Cannot update private_key")
+}
+
+func TestAccountCABundle(t *testing.T) {
+	config, b := getTestConfig(t)
+
+	caBundle, err := ioutil.ReadFile(os.Getenv("LEGO_CA_CERTIFICATES"))
+	require.NoError(t, err)
+
+	// Make sure we are not using the global configuration
+	require.NoError(t, os.Unsetenv("LEGO_CA_CERTIFICATES"))
+
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "accounts/lenstra",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"server_url":              "https://localhost:14000/dir",
+			"contact":                 "remi@lenstra.fr",
+			"terms_of_service_agreed": true,
+			"ca_bundle":               "foo",
+		},
+	}
+	makeRequest(t, b, req, "failed to parse ca_bundle")
+
+	req.Data["ca_bundle"] = string(caBundle)
+	req.Data["http_timeout"] = "30s"
+	req.Data["user_agent"] = "vault-acme-test"
+	resp := makeRequest(t, b, req, "")
+	require.Equal(t, string(caBundle), resp.Data["ca_bundle"])
+	require.Equal(t, 30, resp.Data["http_timeout"])
+	require.Equal(t, "vault-acme-test", resp.Data["user_agent"])
+}
+
+func TestAccountHTTPProxy(t *testing.T) {
+	config, b := getInmemTestConfig(t)
+
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "accounts/lenstra",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"server_url":              "https://localhost:14000/dir",
+			"contact":                 "remi@lenstra.fr",
+			"terms_of_service_agreed": true,
+		},
+	}
+	for _, proxy := range []string{"proxy:3128", "foo", "http://"} {
+		req.Data["http_proxy"] = proxy
+		makeRequest(t, b, req, "http_proxy must be an URL with a scheme and a host, e.g. http://proxy:3128")
+	}
+}
+
+func TestAccountProviderConfigurationRedacted(t *testing.T) {
+	config, b := getTestConfig(t)
+
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "accounts/lenstra",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"server_url":              "https://localhost:14000/dir",
+			"contact":                 "remi@lenstra.fr",
+			"terms_of_service_agreed": true,
+			"provider":                "exec",
+			"provider_configuration": map[string]string{
+				"EXEC_PATH": "/dev/null",
+			},
+		},
+	}
+	resp := makeRequest(t, b, req, "")
+	require.Equal(t, map[string]string{"EXEC_PATH": getTestHMAC(t, config.StorageView, "/dev/null")}, resp.Data["provider_configuration"])
+
+	// Updating the account without provider_configuration keeps it
+	delete(req.Data, "provider_configuration")
+	req.Operation = logical.UpdateOperation
+	resp = makeRequest(t, b, req, "")
+	require.Contains(t, resp.Data["provider_configuration"], "EXEC_PATH")
+
+	// Update a single key
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/lenstra/provider_configuration/EXEC_PROPAGATION_TIMEOUT",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"value": "5",
+		},
+	}
+	resp = makeRequest(t, b, req, "")
+	require.Len(t, resp.Data["provider_configuration"], 2)
+
+	req.Operation = logical.DeleteOperation
+	makeRequest(t, b, req, "")
+
+	a, err := getAccount(context.Background(), config.StorageView, "accounts/lenstra")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"EXEC_PATH": "/dev/null"}, a.ProviderConfiguration)
+}
+
+func TestAccountStatus(t *testing.T) {
+	config, b := getTestConfig(t)
+	createAccount(t, b, config.StorageView)
+
+	// Make the saved registration stale
+	a, err := getAccount(context.Background(), config.StorageView, "accounts/lenstra")
+	require.NoError(t, err)
+	a.Registration.Body.Status = "stale"
+	require.NoError(t, a.save(context.Background(), config.StorageView, "accounts/lenstra", a.ServerURL))
+
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "accounts/lenstra/status",
+		Storage:   config.StorageView,
+	}
+	resp := makeRequest(t, b, req, "")
+	require.Equal(t, "valid", resp.Data["status"])
+	require.Equal(t, []string{"mailto:remi@lenstra.fr"}, resp.Data["contact"])
+
+	// Reading the status does not write to the storage
+	a, err = getAccount(context.Background(), config.StorageView, "accounts/lenstra")
+	require.NoError(t, err)
+	require.Equal(t, "stale", a.Registration.Body.Status)
+
+	req.Operation = logical.UpdateOperation
+	makeRequest(t, b, req, "")
+	a, err = getAccount(context.Background(), config.StorageView, "accounts/lenstra")
+	require.NoError(t, err)
+	require.Equal(t, "valid", a.Registration.Body.Status)
+
+	req.Path = "accounts/unknown/status"
+	makeRequest(t, b, req, "This account does not exists")
+}
+
+func TestResolveServerURL(t *testing.T) {
+	u, alias, err := resolveServerURL("letsencrypt-staging")
+	require.NoError(t, err)
+	require.Equal(t, "https://acme-staging-v02.api.letsencrypt.org/directory", u)
+	require.Equal(t, "letsencrypt-staging", alias)
+
+	u, alias, err = resolveServerURL("https://localhost:14000/dir")
+	require.NoError(t, err)
+	require.Equal(t, "https://localhost:14000/dir", u)
+	require.Equal(t, "", alias)
+
+	_, _, err = resolveServerURL("letsencrpyt")
+	require.EqualError(t, err, "server_url must be an URL or one of buypass, buypass-staging, google, google-staging, letsencrypt, letsencrypt-staging, zerossl")
+}
+
+func TestAccountDirectory(t *testing.T) {
+	config, b := getTestConfig(t)
+	createAccount(t, b, config.StorageView)
+
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "accounts/lenstra/directory",
+		Storage:   config.StorageView,
+	}
+	resp := makeRequest(t, b, req, "")
+	require.Equal(t, "https://localhost:14000/dir", resp.Data["server_url"])
+	require.Equal(t, "https://localhost:14000/sign-me-up", resp.Data["new_account"])
+	require.Equal(t, false, resp.Data["external_account_required"])
+	require.NotEmpty(t, resp.Data["terms_of_service"])
+
+	// The directory is cached
+	cached := makeRequest(t, b, req, "")
+	require.Equal(t, resp.Data["fetched_at"], cached.Data["fetched_at"])
+}
+
+func TestAccountTermsOfService(t *testing.T) {
+	config, b := getTestConfig(t)
+	createAccount(t, b, config.StorageView)
+
+	// Simulate an agreement to older terms of service
+	a, err := getAccount(context.Background(), config.StorageView, "accounts/lenstra")
+	require.NoError(t, err)
+	a.TermsOfServiceURL = "https://example.com/old-terms.pdf"
+	require.NoError(t, a.save(context.Background(), config.StorageView, "accounts/lenstra", a.ServerURL))
+
+	// The check only uses the cached directory
+	makeRequest(t, b, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "accounts/lenstra/directory",
+		Storage:   config.StorageView,
+	}, "")
+
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "accounts/lenstra",
+		Storage:   config.StorageView,
+	}
+	resp := makeRequest(t, b, req, "")
+	require.Equal(t, true, resp.Data["terms_of_service_changed"])
+
+	resp = makeRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/lenstra/agree-terms",
+		Storage:   config.StorageView,
+	}, "")
+	require.Equal(t, false, resp.Data["terms_of_service_changed"])
+	require.NotEqual(t, "https://example.com/old-terms.pdf", resp.Data["terms_of_service_url"])
+}
+
+func TestTermsOfServiceChanged(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"meta": {"termsOfService": "https://localhost/new-terms.pdf"}}`)
+	}))
+	defer server.Close()
+
+	_, lb := getInmemTestConfig(t)
+	b := lb.(*backend)
+	a := &account{ServerURL: server.URL, TermsOfServiceURL: "https://localhost/old-terms.pdf"}
+
+	// The state is unknown until the directory has been fetched in the
+	// background
+	_, known := b.termsOfServiceChanged(a)
+	require.False(t, known)
+	require.Eventually(t, func() bool {
+		_, known := b.termsOfServiceChanged(a)
+		return known
+	}, 5*time.Second, 10*time.Millisecond)
+	changed, _ := b.termsOfServiceChanged(a)
+	require.True(t, changed)
+
+	// The change is only logged once
+	w := newTermsOfServiceWarnings()
+	require.True(t, w.update(server.URL, "old", "new", true))
+	require.False(t, w.update(server.URL, "old", "new", true))
+	require.True(t, w.update(server.URL, "old", "newer", true))
+	require.False(t, w.update(server.URL, "old", "old", false))
+	require.True(t, w.update(server.URL, "old", "newer", true))
+}
+
+func TestMigrateAccount(t *testing.T) {
+	config, b := getTestConfig(t)
+	createAccount(t, b, config.StorageView)
+	createRole(t, b, config.StorageView)
+
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "accounts/lenstra",
+		Storage:   config.StorageView,
+	}
+	before := makeRequest(t, b, req, "")
+
+	migrateReq := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/lenstra/migrate",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"server_url":              "https://localhost:14000/dir",
+			"terms_of_service_agreed": true,
+		},
+	}
+	makeRequest(t, b, migrateReq, "This account already uses this server_url")
+
+	// pebble is also reachable using its IP address
+	migrateReq.Data["server_url"] = "https://127.0.0.1:14000/dir"
+	migrateReq.Data["key_type"] = "EC384"
+	makeRequest(t, b, migrateReq, "key_type can only be changed when regenerate_key is set")
+
+	migrateReq.Data["regenerate_key"] = true
+	after := makeRequest(t, b, migrateReq, "")
+	require.Equal(t, "https://127.0.0.1:14000/dir", after.Data["server_url"])
+	require.Equal(t, "EC384", after.Data["key_type"])
+	require.Equal(t, before.Data["provider"], after.Data["provider"])
+	require.NotEqual(t, before.Data["registration_uri"], after.Data["registration_uri"])
+	require.Equal(t, []string{"lenstra.fr"}, after.Data["roles"])
+}
+
+func TestAccountChallengePreference(t *testing.T) {
+	config, b := getTestConfig(t)
+
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "accounts/lenstra",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"server_url":              "https://localhost:14000/dir",
+			"contact":                 "remi@lenstra.fr",
+			"terms_of_service_agreed": true,
+			"enable_http_01":          true,
+			"challenge_preference":    "http-01,foo",
+		},
+	}
+	makeRequest(t, b, req, `"foo" is not a supported challenge type, must be one of dns-01, http-01, tls-alpn-01`)
+
+	req.Data["challenge_preference"] = "http-01,http-01"
+	makeRequest(t, b, req, `"http-01" is present multiple times in challenge_preference`)
+
+	req.Data["challenge_preference"] = "http-01,dns-01"
+	makeRequest(t, b, req, "dns-01 is in challenge_preference but is not enabled on the account")
+
+	req.Data["provider"] = "exec"
+	resp := makeRequest(t, b, req, "")
+	require.Equal(t, []string{"http-01", "dns-01"}, resp.Data["challenge_preference"])
+}
+
+func TestListBrokenAccount(t *testing.T) {
+	config, b := getInmemTestConfig(t)
+
+	a := newTestAccount(t)
+	require.NoError(t, a.save(context.Background(), config.StorageView, "accounts/lenstra", a.ServerURL))
+	// The key is not needed to list the accounts
+	require.NoError(t, config.StorageView.Delete(context.Background(), "account_keys/lenstra"))
+
+	d := getOldAccountEntry(t)
+	d[schemaVersionKey] = 42
+	putRawEntry(t, config.StorageView, "accounts/broken", d)
+
+	req := &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "accounts",
+		Storage:   config.StorageView,
+	}
+	resp := makeRequest(t, b, req, "")
+	require.Equal(t, []string{"broken", "lenstra"}, resp.Data["keys"])
+	keyInfo := resp.Data["key_info"].(map[string]interface{})
+	require.Equal(t, map[string]interface{}{
+		"error": fmt.Sprintf("account entry has schema version 42 but only versions up to %d are supported, it has probably been written by a newer version of the plugin", accountSchema.version()),
+		"roles": []string{},
+	}, keyInfo["broken"])
+	require.Equal(t, map[string]interface{}{
+		"server_url":          "https://localhost:14000/dir",
+		"contact":             "remi@lenstra.fr",
+		"provider":            "",
+		"status":              "",
+		"certificates_issued": 0,
+		"last_success":        "",
+		"last_failure":        "",
+		"last_error":          "",
+		"roles":               []string{},
+	}, keyInfo["lenstra"])
+}
+
+func TestForceDeleteBrokenAccount(t *testing.T) {
+	config, b := getInmemTestConfig(t)
+
+	// An account written by a newer version of the plugin, without its key
+	d := getOldAccountEntry(t)
+	delete(d, "private_key")
+	d[schemaVersionKey] = 42
+	putRawEntry(t, config.StorageView, "accounts/lenstra", d)
+	require.NoError(t, NewLedger().Record(context.Background(), config.StorageView, "lenstra", ledgerEventSuccess, []string{"lenstra.fr"}, nil))
+
+	req := &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "accounts/lenstra",
+		Storage:   config.StorageView,
+	}
+	_, err := b.HandleRequest(context.Background(), req)
+	require.Error(t, err)
+
+	req.Data = map[string]interface{}{"force": true}
+	makeRequest(t, b, req, "")
+	for _, prefix := range []string{"accounts/", "account_keys/", ledgerPrefix, statsPrefix} {
+		keys, err := config.StorageView.List(context.Background(), prefix)
+		require.NoError(t, err)
+		require.Empty(t, keys, prefix)
+	}
+
+	makeRequest(t, b, req, "This account does not exists")
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/go-acme/lego/v3/certificate"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/ryanuber/go-glob"
 )
 
 func pathCerts(b *backend) *framework.Path {
@@ -63,6 +64,12 @@ func (b *backend) certCreate(ctx context.Context, req *logical.Request, data *fr
 	if a == nil {
 		return logical.ErrorResponse("This account does not exists"), nil
 	}
+	// This only logs a warning, the CA will refuse the order if needed
+	b.termsOfServiceChanged(a)
+	if hasWildcard(names) && !a.challengeEnabled(challengeDNS01) {
+		return logical.ErrorResponse("Wildcard certificates can only be validated with the DNS-01 challenge but the account %q has no DNS provider", r.Account), nil
+	}
+
 	// Lookup cache
 	cacheKey, err := getCacheKey(r, data)
 	if err != nil {
@@ -89,11 +96,30 @@ func (b *backend) certCreate(ctx context.Context, req *logical.Request, data *fr
 
 	// If we did not find a cert, we have to request one
 	if cert == nil {
+		if err = b.ledger.Check(ctx, req.Storage, r.Account, a, names); err != nil {
+			if a.RateLimitAction == rateLimitActionDeny {
+				return logical.ErrorResponse("Refusing to request a new certificate: %s", err), nil
+			}
+			b.Logger().Warn("The rate limits of the account are about to be reached", "account", r.Account, "error", err)
+		}
+
 		b.Logger().Debug("Contacting the ACME provider to get a new certificate")
-		cert, err = getCertFromACMEProvider(ctx, b.Logger(), req, a, names)
+		preference := a.ChallengePreference
+		if len(r.ChallengePreference) > 0 {
+			preference = r.ChallengePreference
+		}
+		// Each challenge type tried is a new order for the CA
+		record := func(event string, err error) error {
+			return b.ledger.Record(ctx, req.Storage, r.Account, event, names, err)
+		}
+		cert, err = getCertFromACMEProvider(ctx, b.Logger(), req, a, names, preference, r.KeyType, record)
 		if err != nil {
 			return logical.ErrorResponse("Failed to validate certificate signing request: %s", err), err
 		}
+		// The certificate has been issued, failing now would waste it
+		if lerr := b.ledger.Record(ctx, req.Storage, r.Account, ledgerEventSuccess, names, nil); lerr != nil {
+			b.Logger().Error("Failed to record the issued certificate in the ledger", "error", lerr)
+		}
 		// Save the cert in the cache for the next request
 		if !r.DisableCache {
 			err = b.cache.Create(ctx, req.Storage, r, cacheKey, cert)
@@ -103,7 +129,7 @@ func (b *backend) certCreate(ctx context.Context, req *logical.Request, data *fr
 		}
 	}
 
-	s, err := b.getSecret(path, cacheKey, cert)
+	s, err := b.getSecret(path, a.ServerURL, cacheKey, cert)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create the secret: %v", err)
 	}
@@ -111,8 +137,41 @@ func (b *backend) certCreate(ctx context.Context, req *logical.Request, data *fr
 	return s, nil
 }
 
+// cacheKeyRole is the part of a role used in the cache keys. The fields added
+// after the first release are omitted when they have their default value so
+// that the certificates cached by older versions of the plugin are still used
+// after an upgrade. The challenge preference does not change the certificates
+// and is not part of it.
+type cacheKeyRole struct {
+	Account                   string
+	AllowedDomains            []string
+	AllowBareDomains          bool
+	AllowSubdomains           bool
+	DisableCache              bool
+	CacheForRatio             int
+	AllowWildcardCertificates bool                  `json:",omitempty"`
+	AllowGlobDomains          bool                  `json:",omitempty"`
+	DomainRules               map[string]domainRule `json:",omitempty"`
+	KeyType                   string                `json:",omitempty"`
+}
+
 func getCacheKey(r *role, data *framework.FieldData) (string, error) {
-	rolePath, err := json.Marshal(r)
+	keyType := r.KeyType
+	if keyType == "RSA2048" {
+		keyType = ""
+	}
+	rolePath, err := json.Marshal(cacheKeyRole{
+		Account:                   r.Account,
+		AllowedDomains:            r.AllowedDomains,
+		AllowBareDomains:          r.AllowBareDomains,
+		AllowSubdomains:           r.AllowSubdomains,
+		DisableCache:              r.DisableCache,
+		CacheForRatio:             r.CacheForRatio,
+		AllowWildcardCertificates: r.AllowWildcardCertificates,
+		AllowGlobDomains:          r.AllowGlobDomains,
+		DomainRules:               r.DomainRules,
+		KeyType:                   keyType,
+	})
 	if err != nil {
 		return "", fmt.Errorf("failed to marshall role: %v", err)
 	}
@@ -129,7 +188,7 @@ func getCacheKey(r *role, data *framework.FieldData) (string, error) {
 	return cachePrefix + string(rolePath) + string(dataPath), nil
 }
 
-func (b *backend) getSecret(accountPath, cacheKey string, cert *certificate.Resource) (*logical.Response, error) {
+func (b *backend) getSecret(accountPath, serverURL, cacheKey string, cert *certificate.Resource) (*logical.Response, error) {
 	// Use the helper to create the secret
 	b.Logger().Debug("Preparing response")
 	certs, err := certcrypto.ParsePEMBundle(cert.Certificate)
@@ -152,10 +211,11 @@ func (b *backend) getSecret(accountPath, cacheKey string, cert *certificate.Reso
 		},
 		// this will be used when revoking the certificate
 		map[string]interface{}{
-			"account":   accountPath,
-			"cert":      string(cert.Certificate),
-			"url":       cert.CertStableURL,
-			"cache_key": cacheKey,
+			"account":    accountPath,
+			"server_url": serverURL,
+			"cert":       string(cert.Certificate),
+			"url":        cert.CertStableURL,
+			"cache_key":  cacheKey,
 		})
 
 	s.Secret.MaxTTL = time.Until(notAfter)
@@ -181,11 +241,31 @@ func validateNames(b logical.Backend, r *role, names []string) error {
 		return strings.HasSuffix(domain, "."+root)
 	}
 
+	domains := r.getAllowedDomains()
 	for _, name := range names {
+		if isWildcard(name) {
+			if !r.allowsWildcards() {
+				return fmt.Errorf("'%s' is a wildcard but the role does not allow wildcard certificates", name)
+			}
+			if strings.Contains(name[2:], "*") {
+				return fmt.Errorf("'%s' is not a valid wildcard, only the leftmost label can be '*'", name)
+			}
+		} else if strings.Contains(name, "*") {
+			return fmt.Errorf("'%s' is not a valid wildcard, only the leftmost label can be '*'", name)
+		}
+
 		var valid bool
-		for _, domain := range r.AllowedDomains {
-			if (domain == name && r.AllowBareDomains) ||
-				(isSubdomain(name, domain) && r.AllowSubdomains) {
+		for _, d := range domains {
+			if isWildcard(name) && !d.AllowWildcardCertificates {
+				continue
+			}
+			// A glob pattern matches the name by itself, '*' can match
+			// several labels
+			if r.AllowGlobDomains && strings.Contains(d.Domain, "*") && glob.Glob(d.Domain, name) {
+				valid = true
+			}
+			if (d.Domain == name && d.AllowBareDomains) ||
+				(isSubdomain(name, d.Domain) && d.AllowSubdomains) {
 				valid = true
 			}
 		}
@@ -196,3 +276,16 @@ func validateNames(b logical.Backend, r *role, names []string) error {
 
 	return nil
 }
+
+func isWildcard(name string) bool {
+	return strings.HasPrefix(name, "*.")
+}
+
+func hasWildcard(names []string) bool {
+	for _, name := range names {
+		if isWildcard(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -10,6 +10,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/go-acme/lego/v3/certificate"
+	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/stretchr/testify/require"
 )
@@ -226,3 +228,67 @@ func checkCertificate(t *testing.T, resp *logical.Response) {
 
 	http.DefaultTransport.(*http.Transport).DialContext = dialContext
 }
+
+func TestCacheKeyCompatibility(t *testing.T) {
+	data := &framework.FieldData{
+		Raw:    map[string]interface{}{"role": "lenstra.fr", "common_name": "www.lenstra.fr"},
+		Schema: pathCerts(&backend{}).Fields,
+	}
+
+	// A role that uses the default values of the fields added since the
+	// first release must keep the cache key used by the older versions
+	r := &role{
+		Account:             "lenstra",
+		AllowedDomains:      []string{"lenstra.fr"},
+		AllowSubdomains:     true,
+		CacheForRatio:       70,
+		KeyType:             "RSA2048",
+		ChallengePreference: []string{"dns-01"},
+		DomainRules:         map[string]domainRule{},
+	}
+	key, err := getCacheKey(r, data)
+	require.NoError(t, err)
+	require.Equal(t, cachePrefix+`{"Account":"lenstra","AllowedDomains":["lenstra.fr"],"AllowBareDomains":false,"AllowSubdomains":true,"DisableCache":false,"CacheForRatio":70}{"alternative_names":[],"common_name":"www.lenstra.fr","role":"lenstra.fr"}`, key)
+
+	// The fields that change the certificates change the key
+	r.KeyType = "EC256"
+	other, err := getCacheKey(r, data)
+	require.NoError(t, err)
+	require.NotEqual(t, key, other)
+}
+
+func TestRevokeMigratedCertificate(t *testing.T) {
+	ctx := context.Background()
+	config, b := getInmemTestConfig(t)
+
+	a := newTestAccount(t)
+	require.NoError(t, a.save(ctx, config.StorageView, "accounts/lenstra", a.ServerURL))
+
+	cert := &certificate.Resource{Domain: "lenstra.fr", Certificate: []byte("cert")}
+	require.NoError(t, NewCacheEntry("lenstra", cert).Save(ctx, config.StorageView, cachePrefix+"lenstra"))
+	require.NoError(t, NewCacheEntry("other", cert).Save(ctx, config.StorageView, cachePrefix+"other"))
+
+	// Migrating an account removes its certificates from the cache
+	cache := NewCache()
+	require.NoError(t, cache.DeleteAccount(ctx, config.StorageView, "lenstra"))
+	keys, err := cache.List(ctx, config.StorageView)
+	require.NoError(t, err)
+	require.Equal(t, []string{"other"}, keys)
+
+	// The certificates issued by the previous CA are not revoked using the
+	// new one
+	req := &logical.Request{
+		Operation: logical.RevokeOperation,
+		Storage:   config.StorageView,
+		Secret: &logical.Secret{
+			InternalData: map[string]interface{}{
+				"secret_type": secretCertType,
+				"account":     "accounts/lenstra",
+				"server_url":  "https://acme-staging-v02.api.letsencrypt.org/directory",
+				"cert":        "cert",
+				"cache_key":   cachePrefix + "lenstra",
+			},
+		},
+	}
+	makeRequest(t, b, req, "")
+}
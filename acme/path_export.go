@@ -0,0 +1,297 @@
+package acme
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// exportBundleVersion is the version of the layout of the export bundles
+const exportBundleVersion = 1
+
+func pathExport(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "export",
+			Fields: map[string]*framework.FieldSchema{
+				// A base64 encoded 256 bits key used to encrypt the bundle
+				"key": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.export,
+			},
+		},
+		{
+			Pattern: "import",
+			Fields: map[string]*framework.FieldSchema{
+				"key": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+				"bundle": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.importBundle,
+			},
+		},
+	}
+}
+
+// exportBundle holds the content of a mount. The accounts include their
+// private key and all the entries use the current version of their schema.
+type exportBundle struct {
+	Version   int                               `json:"version"`
+	Accounts  map[string]map[string]interface{} `json:"accounts"`
+	Roles     map[string]map[string]interface{} `json:"roles"`
+	Providers map[string]map[string]interface{} `json:"providers"`
+	// The ledger entries are indexed by <account>/<registered domain>
+	Ledger map[string]map[string]interface{} `json:"ledger"`
+	Stats  map[string]map[string]interface{} `json:"stats,omitempty"`
+}
+
+func (b *backend) export(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	aead, err := getBundleCipher(data.Get("key").(string))
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	bundle := &exportBundle{
+		Version:   exportBundleVersion,
+		Accounts:  map[string]map[string]interface{}{},
+		Roles:     map[string]map[string]interface{}{},
+		Providers: map[string]map[string]interface{}{},
+		Ledger:    map[string]map[string]interface{}{},
+		Stats:     map[string]map[string]interface{}{},
+	}
+
+	accounts, err := req.Storage.List(ctx, "accounts/")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range accounts {
+		d, err := accountSchema.read(ctx, req.Storage, "accounts/"+name)
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("failed to read account %q: {{err}}", name), err)
+		}
+		if d == nil {
+			continue
+		}
+		// The key is not stored with the account anymore but we need it to
+		// restore it
+		a, err := getAccount(ctx, req.Storage, "accounts/"+name)
+		if err != nil {
+			return nil, err
+		}
+		if d["private_key"], err = encodePrivateKey(a.Key); err != nil {
+			return nil, err
+		}
+		bundle.Accounts[name] = d
+	}
+
+	if err = exportEntries(ctx, req.Storage, "roles/", roleSchema, bundle.Roles); err != nil {
+		return nil, err
+	}
+	if err = exportEntries(ctx, req.Storage, "providers/", nil, bundle.Providers); err != nil {
+		return nil, err
+	}
+
+	b.ledger.Lock()
+	defer b.ledger.Unlock()
+	ledgers, err := req.Storage.List(ctx, ledgerPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, account := range ledgers {
+		entries := map[string]map[string]interface{}{}
+		if err = exportEntries(ctx, req.Storage, ledgerPrefix+account, nil, entries); err != nil {
+			return nil, err
+		}
+		for domain, entry := range entries {
+			bundle.Ledger[account+domain] = entry
+		}
+	}
+	if err = exportEntries(ctx, req.Storage, statsPrefix, nil, bundle.Stats); err != nil {
+		return nil, err
+	}
+
+	plaintext, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	ciphertext := aead.Seal(nonce, nonce, plaintext, nil)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"bundle":    base64.StdEncoding.EncodeToString(ciphertext),
+			"accounts":  len(bundle.Accounts),
+			"roles":     len(bundle.Roles),
+			"providers": len(bundle.Providers),
+		},
+	}, nil
+}
+
+func (b *backend) importBundle(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	aead, err := getBundleCipher(data.Get("key").(string))
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(data.Get("bundle").(string))
+	if err != nil || len(ciphertext) < aead.NonceSize() {
+		return logical.ErrorResponse("bundle is not valid"), nil
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return logical.ErrorResponse("Failed to decrypt the bundle, the key may be wrong"), nil
+	}
+
+	var bundle exportBundle
+	if err = json.Unmarshal(plaintext, &bundle); err != nil {
+		return logical.ErrorResponse("Failed to decode the bundle: %s", err), nil
+	}
+	if bundle.Version != exportBundleVersion {
+		return logical.ErrorResponse("Unsupported bundle version %d", bundle.Version), nil
+	}
+
+	// Restoring over existing entries would mix two configurations
+	for _, prefix := range []string{"accounts/", "roles/", "providers/"} {
+		keys, err := req.Storage.List(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) > 0 {
+			return logical.ErrorResponse("The mount must be empty to import a bundle but %s is not", prefix), nil
+		}
+	}
+
+	// Check all the entries before writing anything so a bundle made by a
+	// newer version of the plugin is refused as a whole
+	for name, d := range bundle.Accounts {
+		if _, err = accountSchema.migrate(d); err != nil {
+			return logical.ErrorResponse("Invalid account %q: %s", name, err), nil
+		}
+		if _, ok := d["private_key"].(string); !ok {
+			return logical.ErrorResponse("Invalid account %q: the private key is missing", name), nil
+		}
+	}
+	for name, d := range bundle.Roles {
+		if _, err = roleSchema.migrate(d); err != nil {
+			return logical.ErrorResponse("Invalid role %q: %s", name, err), nil
+		}
+	}
+	for key := range bundle.Ledger {
+		if !strings.Contains(key, "/") {
+			return logical.ErrorResponse("Invalid ledger entry %q", key), nil
+		}
+	}
+
+	entries := map[string]map[string]interface{}{}
+	for name, d := range bundle.Accounts {
+		entries["accounts/"+name] = d
+	}
+	for name, d := range bundle.Roles {
+		entries["roles/"+name] = d
+	}
+	for name, d := range bundle.Providers {
+		entries["providers/"+name] = d
+	}
+	for key, d := range bundle.Ledger {
+		entries[ledgerPrefix+key] = d
+	}
+	for name, d := range bundle.Stats {
+		entries[statsPrefix+name] = d
+	}
+	for path, d := range entries {
+		storageEntry, err := logical.StorageEntryJSON(path, d)
+		if err != nil {
+			return nil, err
+		}
+		if err = req.Storage.Put(ctx, storageEntry); err != nil {
+			return nil, err
+		}
+	}
+
+	// The accounts were written with their private key, it must now be moved
+	// to its own entry
+	if err = moveAccountKeys(ctx, req.Storage); err != nil {
+		return nil, errwrap.Wrapf("failed to store the account keys: {{err}}", err)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"accounts":  len(bundle.Accounts),
+			"roles":     len(bundle.Roles),
+			"providers": len(bundle.Providers),
+		},
+	}, nil
+}
+
+// exportEntries adds the entries under prefix to entries, upgrading them to
+// the current version of s when it is set
+func exportEntries(ctx context.Context, storage logical.Storage, prefix string, s *schema, entries map[string]map[string]interface{}) error {
+	keys, err := storage.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		var d map[string]interface{}
+		if s != nil {
+			if d, err = s.read(ctx, storage, prefix+key); err != nil {
+				return err
+			}
+		} else {
+			storageEntry, err := storage.Get(ctx, prefix+key)
+			if err != nil {
+				return err
+			}
+			if storageEntry != nil {
+				if err = storageEntry.DecodeJSON(&d); err != nil {
+					return err
+				}
+			}
+		}
+		if d != nil {
+			entries[key] = d
+		}
+	}
+
+	return nil
+}
+
+// getBundleCipher returns the AES-GCM cipher used to encrypt the bundles with
+// the base64 encoded key
+func getBundleCipher(key string) (cipher.AEAD, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(k) != 32 {
+		return nil, errors.New("key must be a base64 encoded 256 bits key")
+	}
+
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
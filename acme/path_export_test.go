@@ -0,0 +1,102 @@
+package acme
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+
+	config, b := getInmemTestConfig(t)
+	a := newTestAccount(t)
+	a.DNSProvider = "route53"
+	a.ProviderConfiguration = map[string]string{}
+	a.DNSZoneProviders = map[string]string{}
+	a.DNSResolvers = []string{"127.0.0.1:8053"}
+	a.HTTPTimeout = 30
+	a.RateLimitAction = rateLimitActionDeny
+	require.NoError(t, a.save(ctx, config.StorageView, "accounts/lenstra", a.ServerURL))
+
+	p := &provider{Provider: "route53", Configuration: map[string]string{"AWS_REGION": "eu-west-1"}}
+	require.NoError(t, p.save(ctx, config.StorageView, "providers/route53"))
+
+	r := &role{Account: "lenstra", AllowedDomains: []string{"lenstra.fr"}, AllowSubdomains: true, CacheForRatio: 70, KeyType: "EC256", ChallengePreference: []string{}}
+	require.NoError(t, r.save(ctx, config.StorageView, "roles/lenstra.fr"))
+
+	require.NoError(t, NewLedger().Record(ctx, config.StorageView, "lenstra", ledgerEventSuccess, []string{"www.lenstra.fr"}, nil))
+
+	exportKey := make([]byte, 32)
+	_, err := rand.Read(exportKey)
+	require.NoError(t, err)
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "export",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"key": "foo",
+		},
+	}
+	makeRequest(t, b, req, "key must be a base64 encoded 256 bits key")
+
+	req.Data["key"] = base64.StdEncoding.EncodeToString(exportKey)
+	resp := makeRequest(t, b, req, "")
+	require.Equal(t, 1, resp.Data["accounts"])
+	require.Equal(t, 1, resp.Data["roles"])
+	require.Equal(t, 1, resp.Data["providers"])
+	bundle := resp.Data["bundle"].(string)
+
+	// The bundle can only be imported in an empty mount
+	importReq := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "import",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"key":    base64.StdEncoding.EncodeToString(exportKey),
+			"bundle": bundle,
+		},
+	}
+	makeRequest(t, b, importReq, "The mount must be empty to import a bundle but accounts/ is not")
+
+	restoreConfig, restored := getInmemTestConfig(t)
+	importReq.Storage = restoreConfig.StorageView
+
+	importReq.Data["key"] = base64.StdEncoding.EncodeToString(make([]byte, 32))
+	makeRequest(t, restored, importReq, "Failed to decrypt the bundle, the key may be wrong")
+
+	importReq.Data["key"] = base64.StdEncoding.EncodeToString(exportKey)
+	resp = makeRequest(t, restored, importReq, "")
+	require.Equal(t, 1, resp.Data["accounts"])
+
+	restoredAccount, err := getAccount(ctx, restoreConfig.StorageView, "accounts/lenstra")
+	require.NoError(t, err)
+	require.Equal(t, a, restoredAccount)
+
+	// The key has been moved to its own entry
+	keyEntry, err := restoreConfig.StorageView.Get(ctx, "account_keys/lenstra")
+	require.NoError(t, err)
+	require.NotNil(t, keyEntry)
+
+	restoredRole, err := getRole(ctx, restoreConfig.StorageView, "roles/lenstra.fr")
+	require.NoError(t, err)
+	require.Equal(t, r, restoredRole)
+
+	restoredProvider, err := getProvider(ctx, restoreConfig.StorageView, "providers/route53")
+	require.NoError(t, err)
+	require.Equal(t, p, restoredProvider)
+
+	entry, err := NewLedger().Read(ctx, restoreConfig.StorageView, "lenstra", "lenstra.fr")
+	require.NoError(t, err)
+	require.Len(t, entry.Events, 1)
+	require.Equal(t, []string{"www.lenstra.fr"}, entry.Events[0].Names)
+
+	stats, err := NewLedger().Stats(ctx, restoreConfig.StorageView, "lenstra")
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.CertificatesIssued)
+}
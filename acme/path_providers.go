@@ -0,0 +1,415 @@
+package acme
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge"
+	"github.com/go-acme/lego/v3/challenge/dns01"
+	"github.com/go-acme/lego/v3/providers/dns"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/mitchellh/mapstructure"
+)
+
+func pathProviders(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "providers/?$",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.providerList,
+			},
+		},
+		{
+			Pattern: "providers/" + framework.GenericNameRegex("name"),
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+				"provider": {
+					Type:     framework.TypeString,
+					Required: true,
+				},
+				"provider_configuration": {
+					Type: framework.TypeKVPairs,
+				},
+			},
+			ExistenceCheck: b.pathExistenceCheck,
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.providerWrite,
+				logical.ReadOperation:   b.providerRead,
+				logical.UpdateOperation: b.providerWrite,
+				logical.DeleteOperation: b.providerDelete,
+			},
+		},
+	}
+}
+
+func (b *backend) providerWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := data.Validate(); err != nil {
+		return nil, err
+	}
+
+	p, err := getProvider(ctx, req.Storage, req.Path)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		p = &provider{}
+	}
+
+	p.Provider = data.Get("provider").(string)
+	if p.Provider == "" {
+		return logical.ErrorResponse("provider must be set"), nil
+	}
+	// The configuration is write-only so we keep the current one when it is
+	// not given during an update
+	if _, ok := data.GetOk("provider_configuration"); ok || p.Configuration == nil {
+		p.Configuration = data.Get("provider_configuration").(map[string]string)
+	}
+
+	if err = p.save(ctx, req.Storage, req.Path); err != nil {
+		return nil, err
+	}
+
+	return b.providerRead(ctx, req, data)
+}
+
+func (b *backend) providerRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	p, err := getProvider(ctx, req.Storage, req.Path)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return logical.ErrorResponse("This provider does not exists"), nil
+	}
+	providerConfiguration, err := b.redactProviderConfiguration(ctx, p.Configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"provider":               p.Provider,
+			"provider_configuration": providerConfiguration,
+		},
+	}, nil
+}
+
+func (b *backend) providerDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	accounts, err := req.Storage.List(ctx, "accounts/")
+	if err != nil {
+		return nil, err
+	}
+	for _, accountName := range accounts {
+		a, err := getAccount(ctx, req.Storage, "accounts/"+accountName)
+		if err != nil {
+			return nil, err
+		}
+		if a != nil && a.usesProvider(name) {
+			return logical.ErrorResponse("This provider is used by account %q", accountName), nil
+		}
+	}
+
+	return nil, req.Storage.Delete(ctx, req.Path)
+}
+
+func (b *backend) providerList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	entries, err := req.Storage.List(ctx, "providers/")
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(entries), nil
+}
+
+// provider is a named lego DNS provider configuration that can be shared
+// between accounts
+type provider struct {
+	Provider      string
+	Configuration map[string]string
+}
+
+func getProvider(ctx context.Context, storage logical.Storage, path string) (*provider, error) {
+	storageEntry, err := storage.Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if storageEntry == nil {
+		return nil, nil
+	}
+
+	var d map[string]interface{}
+	err = storageEntry.DecodeJSON(&d)
+	if err != nil {
+		return nil, err
+	}
+
+	var p *provider
+	err = mapstructure.Decode(d, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *provider) save(ctx context.Context, storage logical.Storage, path string) error {
+	var data map[string]interface{}
+	err := mapstructure.Decode(p, &data)
+	if err != nil {
+		return err
+	}
+
+	storageEntry, err := logical.StorageEntryJSON(path, data)
+	if err != nil {
+		return err
+	}
+
+	return storage.Put(ctx, storageEntry)
+}
+
+// ttlOptions is the name of the option each lego DNS provider reads the TTL of
+// the TXT records from, the providers that are not listed do not support it
+var ttlOptions = map[string]string{
+	"alidns":       "ALICLOUD_TTL",
+	"arvancloud":   "ARVANCLOUD_TTL",
+	"azure":        "AZURE_TTL",
+	"auroradns":    "AURORA_TTL",
+	"autodns":      "AUTODNS_TTL",
+	"bluecat":      "BLUECAT_TTL",
+	"checkdomain":  "CHECKDOMAIN_TTL",
+	"clouddns":     "CLOUDDNS_TTL",
+	"cloudns":      "CLOUDNS_TTL",
+	"cloudxns":     "CLOUDXNS_TTL",
+	"conoha":       "CONOHA_TTL",
+	"constellix":   "CONSTELLIX_TTL",
+	"desec":        "DESEC_TTL",
+	"designate":    "DESIGNATE_TTL",
+	"digitalocean": "DO_TTL",
+	"dnsimple":     "DNSIMPLE_TTL",
+	"dnsmadeeasy":  "DNSMADEEASY_TTL",
+	"dnspod":       "DNSPOD_TTL",
+	"dyn":          "DYN_TTL",
+	"dynu":         "DYNU_TTL",
+	"edgedns":      "AKAMAI_TTL",
+	"fastdns":      "AKAMAI_TTL",
+	"easydns":      "EASYDNS_TTL",
+	"exoscale":     "EXOSCALE_TTL",
+	"gandi":        "GANDI_TTL",
+	"gandiv5":      "GANDIV5_TTL",
+	"glesys":       "GLESYS_TTL",
+	"gcloud":       "GCE_TTL",
+	"godaddy":      "GODADDY_TTL",
+	"hetzner":      "HETZNER_TTL",
+	"hostingde":    "HOSTINGDE_TTL",
+	"hyperone":     "HYPERONE_TTL",
+	"iij":          "IIJ_TTL",
+	"inwx":         "INWX_TTL",
+	"joker":        "JOKER_TTL",
+	"linode":       "LINODE_TTL",
+	"linodev4":     "LINODE_TTL",
+	"liquidweb":    "LIQUID_WEB_TTL",
+	"luadns":       "LUADNS_TTL",
+	"mythicbeasts": "MYTHICBEASTS_TTL",
+	"namecheap":    "NAMECHEAP_TTL",
+	"namedotcom":   "NAMECOM_TTL",
+	"namesilo":     "NAMESILO_TTL",
+	"netcup":       "NETCUP_TTL",
+	"netlify":      "NETLIFY_TTL",
+	"nifcloud":     "NIFCLOUD_TTL",
+	"ns1":          "NS1_TTL",
+	"oraclecloud":  "OCI_TTL",
+	"otc":          "OTC_TTL",
+	"ovh":          "OVH_TTL",
+	"pdns":         "PDNS_TTL",
+	"rackspace":    "RACKSPACE_TTL",
+	"regru":        "REGRU_TTL",
+	"rfc2136":      "RFC2136_TTL",
+	"rimuhosting":  "RIMUHOSTING_TTL",
+	"route53":      "AWS_TTL",
+	"sakuracloud":  "SAKURACLOUD_TTL",
+	"scaleway":     "SCALEWAY_TTL",
+	"selectel":     "SELECTEL_TTL",
+	"servercow":    "SERVERCOW_TTL",
+	"stackpath":    "STACKPATH_TTL",
+	"transip":      "TRANSIP_TTL",
+	"vegadns":      "VEGADNS_TTL",
+	"versio":       "VERSIO_TTL",
+	"vultr":        "VULTR_TTL",
+	"vscale":       "VSCALE_TTL",
+	"yandex":       "YANDEX_TTL",
+	"zonomi":       "ZONOMI_TTL",
+	"cloudflare":   "CLOUDFLARE_TTL",
+}
+
+// checkTTLSupport returns an error when the DNS provider named name does not
+// let us set the TTL of the TXT records
+func checkTTLSupport(name string) error {
+	if _, ok := ttlOptions[name]; !ok {
+		return fmt.Errorf("the %q DNS provider does not support txt_ttl", name)
+	}
+	return nil
+}
+
+// newDNSProvider builds the lego DNS provider described by p. When ttl is set
+// it is given to the provider using its TTL option unless the configuration
+// already sets it.
+func (p *provider) newDNSProvider(ttl int) (challenge.Provider, error) {
+	configuration := p.Configuration
+	if ttl > 0 {
+		if err := checkTTLSupport(p.Provider); err != nil {
+			return nil, err
+		}
+		configuration = make(map[string]string, len(p.Configuration)+1)
+		for k, v := range p.Configuration {
+			configuration[k] = v
+		}
+		key := ttlOptions[p.Provider]
+		if _, ok := configuration[key]; !ok {
+			configuration[key] = strconv.Itoa(ttl)
+		}
+	}
+	return dns.NewDNSChallengeProviderByName(p.Provider, configuration)
+}
+
+// timeoutProvider overrides the propagation timeout and the polling interval
+// of a DNS provider
+type timeoutProvider struct {
+	challenge.Provider
+	timeout  time.Duration
+	interval time.Duration
+}
+
+func (p *timeoutProvider) Timeout() (timeout, interval time.Duration) {
+	timeout, interval = dns01.DefaultPropagationTimeout, dns01.DefaultPollingInterval
+	if pt, ok := p.Provider.(challenge.ProviderTimeout); ok {
+		timeout, interval = pt.Timeout()
+	}
+	if p.timeout > 0 {
+		timeout = p.timeout
+	}
+	if p.interval > 0 {
+		interval = p.interval
+	}
+	return timeout, interval
+}
+
+// sequentialTimeoutProvider is a timeoutProvider wrapping a provider that must
+// solve the challenges one at a time
+type sequentialTimeoutProvider struct {
+	*timeoutProvider
+}
+
+func (p *sequentialTimeoutProvider) Sequential() time.Duration {
+	return p.Provider.(sequentialProvider).Sequential()
+}
+
+func newTimeoutProvider(provider challenge.Provider, timeout, interval time.Duration) challenge.Provider {
+	p := &timeoutProvider{
+		Provider: provider,
+		timeout:  timeout,
+		interval: interval,
+	}
+	if _, ok := provider.(sequentialProvider); ok {
+		return &sequentialTimeoutProvider{p}
+	}
+	return p
+}
+
+// getDNSProvider returns the DNS provider configuration of the account, either
+// from the named provider it references or from its own settings. It returns
+// nil when the DNS-01 challenge is not enabled.
+func (a *account) getDNSProvider(ctx context.Context, storage logical.Storage) (*provider, error) {
+	if a.DNSProvider != "" {
+		p, err := getProvider(ctx, storage, "providers/"+a.DNSProvider)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			return nil, fmt.Errorf("provider %q does not exists", a.DNSProvider)
+		}
+		return p, nil
+	}
+
+	if a.Provider != "" {
+		return &provider{
+			Provider:      a.Provider,
+			Configuration: a.ProviderConfiguration,
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// newDNS01Provider builds the DNS-01 provider of the account. When zone
+// providers are configured, a provider dispatching each challenge based on
+// its domain is returned. It returns nil when the DNS-01 challenge is not
+// enabled.
+func (a *account) newDNS01Provider(ctx context.Context, storage logical.Storage) (challenge.Provider, error) {
+	provider, err := a.buildDNS01Provider(ctx, storage)
+	if err != nil || provider == nil {
+		return nil, err
+	}
+
+	if a.PropagationTimeout > 0 || a.PollingInterval > 0 {
+		provider = newTimeoutProvider(
+			provider,
+			time.Duration(a.PropagationTimeout)*time.Second,
+			time.Duration(a.PollingInterval)*time.Second,
+		)
+	}
+
+	return provider, nil
+}
+
+func (a *account) buildDNS01Provider(ctx context.Context, storage logical.Storage) (challenge.Provider, error) {
+	var fallback challenge.Provider
+	p, err := a.getDNSProvider(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+	if p != nil {
+		if fallback, err = p.newDNSProvider(a.TXTTTL); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(a.DNSZoneProviders) == 0 {
+		return fallback, nil
+	}
+
+	zones := make(map[string]challenge.Provider, len(a.DNSZoneProviders))
+	for zone, name := range a.DNSZoneProviders {
+		zp, err := getProvider(ctx, storage, "providers/"+name)
+		if err != nil {
+			return nil, err
+		}
+		if zp == nil {
+			return nil, fmt.Errorf("provider %q does not exists", name)
+		}
+		if zones[zone], err = zp.newDNSProvider(a.TXTTTL); err != nil {
+			return nil, err
+		}
+	}
+
+	return newZoneProvider(zones, fallback), nil
+}
+
+// usesProvider returns whether the account references the named provider
+func (a *account) usesProvider(name string) bool {
+	if a.DNSProvider == name {
+		return true
+	}
+	for _, p := range a.DNSZoneProviders {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
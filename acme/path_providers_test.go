@@ -0,0 +1,218 @@
+package acme
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviders(t *testing.T) {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b, err := Factory(context.Background(), config)
+	require.NoError(t, err)
+
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "providers/exec",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"provider": "exec",
+			"provider_configuration": map[string]string{
+				"EXEC_PATH": "/dev/null",
+			},
+		},
+	}
+	resp := makeRequest(t, b, req, "")
+	require.Equal(t, map[string]interface{}{
+		"provider":               "exec",
+		"provider_configuration": map[string]string{"EXEC_PATH": getTestHMAC(t, config.StorageView, "/dev/null")},
+	}, resp.Data)
+
+	// The configuration is kept when it is not given
+	delete(req.Data, "provider_configuration")
+	req.Operation = logical.UpdateOperation
+	resp = makeRequest(t, b, req, "")
+	require.Contains(t, resp.Data["provider_configuration"], "EXEC_PATH")
+
+	listResp := makeRequest(t, b, &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "providers",
+		Storage:   config.StorageView,
+	}, "")
+	require.Equal(t, map[string]interface{}{"keys": []string{"exec"}}, listResp.Data)
+
+	req.Operation = logical.DeleteOperation
+	makeRequest(t, b, req, "")
+
+	req.Operation = logical.ReadOperation
+	makeRequest(t, b, req, "This provider does not exists")
+}
+
+func TestAccountWithNamedProvider(t *testing.T) {
+	config, b := getTestConfig(t)
+
+	accountReq := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "accounts/lenstra",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"server_url":              "https://localhost:14000/dir",
+			"contact":                 "remi@lenstra.fr",
+			"terms_of_service_agreed": true,
+			"dns_provider":            "exec",
+			"dns_resolvers":           []string{"127.0.0.1:8053"},
+			"ignore_dns_propagation":  true,
+		},
+	}
+	makeRequest(t, b, accountReq, "This provider does not exists")
+
+	providerReq := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "providers/exec",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"provider": "exec",
+		},
+	}
+	makeRequest(t, b, providerReq, "")
+
+	accountReq.Data["provider"] = "exec"
+	makeRequest(t, b, accountReq, "dns_provider cannot be used with provider and provider_configuration")
+
+	delete(accountReq.Data, "provider")
+	resp := makeRequest(t, b, accountReq, "")
+	require.Equal(t, "exec", resp.Data["dns_provider"])
+
+	createRole(t, b, config.StorageView)
+	checkCreatingCerts(t, b, config.StorageView)
+
+	providerReq.Operation = logical.DeleteOperation
+	makeRequest(t, b, providerReq, `This provider is used by account "lenstra"`)
+}
+
+func TestAccountWithZoneProviders(t *testing.T) {
+	config, b := getTestConfig(t)
+
+	accountReq := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "accounts/lenstra",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"server_url":              "https://localhost:14000/dir",
+			"contact":                 "remi@lenstra.fr",
+			"terms_of_service_agreed": true,
+			"dns_zone_providers": map[string]string{
+				"lenstra.fr": "exec",
+			},
+			"dns_resolvers":          []string{"127.0.0.1:8053"},
+			"ignore_dns_propagation": true,
+		},
+	}
+	makeRequest(t, b, accountReq, `The provider "exec" for zone "lenstra.fr" does not exists`)
+
+	providerReq := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "providers/exec",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"provider": "exec",
+		},
+	}
+	makeRequest(t, b, providerReq, "")
+
+	resp := makeRequest(t, b, accountReq, "")
+	require.Equal(t, map[string]string{"lenstra.fr": "exec"}, resp.Data["dns_zone_providers"])
+
+	createRole(t, b, config.StorageView)
+	checkCreatingCerts(t, b, config.StorageView)
+
+	providerReq.Operation = logical.DeleteOperation
+	makeRequest(t, b, providerReq, `This provider is used by account "lenstra"`)
+}
+
+func TestDNS01ProviderTimeouts(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	// The timeouts are set explicitly as the exec provider would otherwise
+	// read them from the environment
+	a := &account{
+		Provider: "exec",
+		ProviderConfiguration: map[string]string{
+			"EXEC_PATH":                "/dev/null",
+			"EXEC_PROPAGATION_TIMEOUT": "90",
+			"EXEC_POLLING_INTERVAL":    "7",
+		},
+	}
+
+	provider, err := a.newDNS01Provider(context.Background(), storage)
+	require.NoError(t, err)
+	timeout, interval := provider.(challenge.ProviderTimeout).Timeout()
+	require.Equal(t, 90*time.Second, timeout)
+	require.Equal(t, 7*time.Second, interval)
+
+	a.PropagationTimeout = 300
+	provider, err = a.newDNS01Provider(context.Background(), storage)
+	require.NoError(t, err)
+	timeout, interval = provider.(challenge.ProviderTimeout).Timeout()
+	require.Equal(t, 5*time.Minute, timeout)
+	require.Equal(t, 7*time.Second, interval)
+
+	a.PollingInterval = 10
+	provider, err = a.newDNS01Provider(context.Background(), storage)
+	require.NoError(t, err)
+	_, interval = provider.(challenge.ProviderTimeout).Timeout()
+	require.Equal(t, 10*time.Second, interval)
+
+	// The exec provider still solves the challenges one at a time
+	sp, ok := provider.(sequentialProvider)
+	require.True(t, ok)
+	require.Equal(t, 90*time.Second, sp.Sequential())
+
+	route53 := &account{
+		Provider:              "route53",
+		ProviderConfiguration: map[string]string{"AWS_REGION": "eu-west-1"},
+		PropagationTimeout:    300,
+	}
+	provider, err = route53.newDNS01Provider(context.Background(), storage)
+	require.NoError(t, err)
+	_, ok = provider.(sequentialProvider)
+	require.False(t, ok)
+
+	// The exec provider cannot set the TTL of the records
+	a.TXTTTL = 60
+	_, err = a.newDNS01Provider(context.Background(), storage)
+	require.EqualError(t, err, `the "exec" DNS provider does not support txt_ttl`)
+}
+
+func TestDNS01ProviderTTL(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	a := &account{
+		Provider:              "route53",
+		ProviderConfiguration: map[string]string{"AWS_REGION": "eu-west-1"},
+		TXTTTL:                60,
+	}
+
+	// getTTL reads the TTL lego will use for the records from the private
+	// configuration of the provider
+	getTTL := func(p challenge.Provider) int64 {
+		return reflect.ValueOf(p).Elem().FieldByName("config").Elem().FieldByName("TTL").Int()
+	}
+
+	provider, err := a.newDNS01Provider(context.Background(), storage)
+	require.NoError(t, err)
+	require.Equal(t, int64(60), getTTL(provider))
+	// The configuration of the account must not be modified
+	require.NotContains(t, a.ProviderConfiguration, "AWS_TTL")
+
+	// The provider configuration has precedence
+	a.ProviderConfiguration["AWS_TTL"] = "120"
+	provider, err = a.newDNS01Provider(context.Background(), storage)
+	require.NoError(t, err)
+	require.Equal(t, int64(120), getTTL(provider))
+}
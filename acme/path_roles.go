@@ -2,6 +2,8 @@ package acme
 
 import (
 	"context"
+	"fmt"
+	"sort"
 
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
@@ -32,6 +34,20 @@ func pathRoles(b *backend) []*framework.Path {
 				"allow_subdomains": {
 					Type: framework.TypeBool,
 				},
+				// Wildcards must match allowed_domains like the other names
+				"allow_wildcard_certificates": {
+					Type: framework.TypeBool,
+				},
+				// Whether the allowed domains containing '*' are glob patterns
+				"allow_glob_domains": {
+					Type: framework.TypeBool,
+				},
+				// Per domain form of allowed_domains, each entry can override
+				// allow_bare_domains, allow_subdomains and
+				// allow_wildcard_certificates for its domain
+				"domain_rules": {
+					Type: framework.TypeMap,
+				},
 				"disable_cache": {
 					Type: framework.TypeBool,
 				},
@@ -39,6 +55,16 @@ func pathRoles(b *backend) []*framework.Path {
 					Type:    framework.TypeInt,
 					Default: 70,
 				},
+				// The type of the private key of the certificates
+				"key_type": {
+					Type:          framework.TypeString,
+					Default:       "RSA2048",
+					AllowedValues: certificateKeyTypes,
+				},
+				// Overrides the challenge_preference of the account
+				"challenge_preference": {
+					Type: framework.TypeCommaStringSlice,
+				},
 			},
 			Callbacks: map[logical.Operation]framework.OperationFunc{
 				logical.CreateOperation: b.roleCreateOrUpdate,
@@ -60,13 +86,45 @@ func (b *backend) roleCreateOrUpdate(ctx context.Context, req *logical.Request,
 		return logical.ErrorResponse("cache_for_ration should be greater than 0 and less than 100"), nil
 	}
 
+	keyType := data.Get("key_type").(string)
+	if err := validateCertificateKeyType(keyType); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	challengePreference := data.Get("challenge_preference").([]string)
+	if err := validateChallengePreference(challengePreference); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	accountName := data.Get("account").(string)
+	a, err := getAccount(ctx, req.Storage, "accounts/"+accountName)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return logical.ErrorResponse("This account does not exists"), nil
+	}
+
+	domainRules, err := parseDomainRules(data.Get("domain_rules").(map[string]interface{}))
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
 	r := role{
-		Account:          data.Get("account").(string),
-		AllowedDomains:   data.Get("allowed_domains").([]string),
-		AllowBareDomains: data.Get("allow_bare_domains").(bool),
-		AllowSubdomains:  data.Get("allow_subdomains").(bool),
-		DisableCache:     data.Get("disable_cache").(bool),
-		CacheForRatio:    cacheForRatio,
+		Account:                   accountName,
+		AllowedDomains:            data.Get("allowed_domains").([]string),
+		AllowBareDomains:          data.Get("allow_bare_domains").(bool),
+		AllowSubdomains:           data.Get("allow_subdomains").(bool),
+		AllowWildcardCertificates: data.Get("allow_wildcard_certificates").(bool),
+		AllowGlobDomains:          data.Get("allow_glob_domains").(bool),
+		DomainRules:               domainRules,
+		DisableCache:              data.Get("disable_cache").(bool),
+		CacheForRatio:             cacheForRatio,
+		KeyType:                   keyType,
+		ChallengePreference:       challengePreference,
+	}
+	if r.allowsWildcards() && !a.challengeEnabled(challengeDNS01) {
+		return logical.ErrorResponse("Wildcard certificates can only be validated with the DNS-01 challenge but the account %q has no DNS provider", accountName), nil
 	}
 	if err := r.save(ctx, req.Storage, req.Path); err != nil {
 		return nil, err
@@ -84,14 +142,28 @@ func (b *backend) roleRead(ctx context.Context, req *logical.Request, data *fram
 		return logical.ErrorResponse("This role does not exists"), nil
 	}
 
+	challengePreference := r.ChallengePreference
+	if challengePreference == nil {
+		challengePreference = []string{}
+	}
+	domainRules := r.DomainRules
+	if domainRules == nil {
+		domainRules = map[string]domainRule{}
+	}
+
 	return &logical.Response{
 		Data: map[string]interface{}{
-			"account":            r.Account,
-			"allowed_domains":    r.AllowedDomains,
-			"allow_bare_domains": r.AllowBareDomains,
-			"allow_subdomains":   r.AllowSubdomains,
-			"disable_cache":      r.DisableCache,
-			"cache_for_ratio":    r.CacheForRatio,
+			"account":                     r.Account,
+			"challenge_preference":        challengePreference,
+			"allowed_domains":             r.AllowedDomains,
+			"allow_bare_domains":          r.AllowBareDomains,
+			"allow_subdomains":            r.AllowSubdomains,
+			"allow_wildcard_certificates": r.AllowWildcardCertificates,
+			"allow_glob_domains":          r.AllowGlobDomains,
+			"domain_rules":                domainRules,
+			"disable_cache":               r.DisableCache,
+			"cache_for_ratio":             r.CacheForRatio,
+			"key_type":                    r.KeyType,
 		},
 	}, nil
 }
@@ -109,29 +181,142 @@ func (b *backend) roleList(ctx context.Context, req *logical.Request, data *fram
 	return logical.ListResponse(entries), nil
 }
 
+// getAccountRoles returns the names of the roles using the account
+func getAccountRoles(ctx context.Context, storage logical.Storage, account string) ([]string, error) {
+	entries, err := storage.List(ctx, "roles/")
+	if err != nil {
+		return nil, err
+	}
+
+	roles := []string{}
+	for _, name := range entries {
+		r, err := getRole(ctx, storage, "roles/"+name)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil && r.Account == account {
+			roles = append(roles, name)
+		}
+	}
+
+	return roles, nil
+}
+
 type role struct {
-	Account          string
-	AllowedDomains   []string
-	AllowBareDomains bool
-	AllowSubdomains  bool
-	DisableCache     bool
-	CacheForRatio    int
+	Account                   string
+	AllowedDomains            []string
+	AllowBareDomains          bool
+	AllowSubdomains           bool
+	AllowWildcardCertificates bool
+	AllowGlobDomains          bool
+	DomainRules               map[string]domainRule
+	DisableCache              bool
+	CacheForRatio             int
+	KeyType                   string
+	ChallengePreference       []string
 }
 
-func getRole(ctx context.Context, storage logical.Storage, path string) (*role, error) {
-	storageEntry, err := storage.Get(ctx, path)
-	if err != nil {
-		return nil, err
+// domainRule holds the permissions of a domain in domain_rules, the ones that
+// are not set use the value of the role
+type domainRule struct {
+	AllowBareDomains          *bool `json:"allow_bare_domains,omitempty" mapstructure:"allow_bare_domains"`
+	AllowSubdomains           *bool `json:"allow_subdomains,omitempty" mapstructure:"allow_subdomains"`
+	AllowWildcardCertificates *bool `json:"allow_wildcard_certificates,omitempty" mapstructure:"allow_wildcard_certificates"`
+}
+
+// allowedDomain is an allowed domain of a role with its permissions resolved
+type allowedDomain struct {
+	Domain                    string
+	AllowBareDomains          bool
+	AllowSubdomains           bool
+	AllowWildcardCertificates bool
+}
+
+func parseDomainRules(raw map[string]interface{}) (map[string]domainRule, error) {
+	rules := map[string]domainRule{}
+	for domain, v := range raw {
+		if domain == "" {
+			return nil, fmt.Errorf("domain_rules cannot contain an empty domain")
+		}
+
+		var rule domainRule
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			ErrorUnused:      true,
+			WeaklyTypedInput: true,
+			Result:           &rule,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = decoder.Decode(v); err != nil {
+			return nil, fmt.Errorf("invalid rule for %q in domain_rules: %s", domain, err)
+		}
+		rules[domain] = rule
+	}
+
+	return rules, nil
+}
+
+// getAllowedDomains returns the domains of allowed_domains followed by the
+// ones of domain_rules with the permissions that apply to them
+func (r *role) getAllowedDomains() []allowedDomain {
+	var domains []allowedDomain
+	for _, domain := range r.AllowedDomains {
+		domains = append(domains, allowedDomain{
+			Domain:                    domain,
+			AllowBareDomains:          r.AllowBareDomains,
+			AllowSubdomains:           r.AllowSubdomains,
+			AllowWildcardCertificates: r.AllowWildcardCertificates,
+		})
 	}
-	if storageEntry == nil {
-		return nil, nil
+
+	names := make([]string, 0, len(r.DomainRules))
+	for name := range r.DomainRules {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	var d map[string]interface{}
-	err = storageEntry.DecodeJSON(&d)
-	if err != nil {
+	orDefault := func(v *bool, d bool) bool {
+		if v == nil {
+			return d
+		}
+		return *v
+	}
+	for _, name := range names {
+		rule := r.DomainRules[name]
+		domains = append(domains, allowedDomain{
+			Domain:                    name,
+			AllowBareDomains:          orDefault(rule.AllowBareDomains, r.AllowBareDomains),
+			AllowSubdomains:           orDefault(rule.AllowSubdomains, r.AllowSubdomains),
+			AllowWildcardCertificates: orDefault(rule.AllowWildcardCertificates, r.AllowWildcardCertificates),
+		})
+	}
+
+	return domains
+}
+
+// allowsWildcards returns whether some wildcard certificates can be issued
+// for the role
+func (r *role) allowsWildcards() bool {
+	if r.AllowWildcardCertificates {
+		return true
+	}
+	for _, d := range r.getAllowedDomains() {
+		if d.AllowWildcardCertificates {
+			return true
+		}
+	}
+	return false
+}
+
+func getRole(ctx context.Context, storage logical.Storage, path string) (*role, error) {
+	d, err := roleSchema.read(ctx, storage, path)
+	if err != nil || d == nil {
 		return nil, err
 	}
+	// The schema version is not part of the role as it is used to compute
+	// the cache keys
+	delete(d, schemaVersionKey)
 
 	var r *role
 	err = mapstructure.Decode(d, &r)
@@ -148,6 +333,7 @@ func (r *role) save(ctx context.Context, storage logical.Storage, path string) e
 	if err != nil {
 		return err
 	}
+	data[schemaVersionKey] = roleSchema.version()
 
 	storageEntry, err := logical.StorageEntryJSON(path, data)
 	if err != nil {
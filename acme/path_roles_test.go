@@ -1,6 +1,7 @@
 package acme
 
 import (
+	"context"
 	"testing"
 
 	"github.com/hashicorp/vault/sdk/logical"
@@ -43,3 +44,108 @@ func TestListRoles(t *testing.T) {
 		"keys": []string{"lenstra"},
 	}, listResp.Data)
 }
+
+func TestRoleAccountIntegrity(t *testing.T) {
+	config, b := getTestConfig(t)
+
+	roleReq := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "roles/lenstra.fr",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"account": "lenstra",
+		},
+	}
+	makeRequest(t, b, roleReq, "This account does not exists")
+
+	createAccount(t, b, config.StorageView)
+	makeRequest(t, b, roleReq, "")
+
+	accountReq := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "accounts/lenstra",
+		Storage:   config.StorageView,
+	}
+	resp := makeRequest(t, b, accountReq, "")
+	require.Equal(t, []string{"lenstra.fr"}, resp.Data["roles"])
+
+	accountReq.Operation = logical.DeleteOperation
+	makeRequest(t, b, accountReq, "This account is used by roles lenstra.fr, use force=true to delete it anyway")
+
+	accountReq.Data = map[string]interface{}{"force": true}
+	makeRequest(t, b, accountReq, "")
+}
+
+func TestRoleWildcardCertificates(t *testing.T) {
+	config, b := getInmemTestConfig(t)
+	a := newTestAccount(t)
+	require.NoError(t, a.save(context.Background(), config.StorageView, "accounts/lenstra", a.ServerURL))
+
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "roles/lenstra.fr",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"account":                     "lenstra",
+			"allowed_domains":             "lenstra.fr",
+			"allow_subdomains":            true,
+			"allow_wildcard_certificates": true,
+		},
+	}
+	makeRequest(t, b, req, `Wildcard certificates can only be validated with the DNS-01 challenge but the account "lenstra" has no DNS provider`)
+
+	a.DNSProvider = "route53"
+	require.NoError(t, a.save(context.Background(), config.StorageView, "accounts/lenstra", a.ServerURL))
+	resp := makeRequest(t, b, req, "")
+	require.Equal(t, true, resp.Data["allow_wildcard_certificates"])
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestParseDomainRules(t *testing.T) {
+	rules, err := parseDomainRules(map[string]interface{}{
+		"lenstra.fr":          map[string]interface{}{"allow_bare_domains": true, "allow_subdomains": "false"},
+		"internal.lenstra.fr": map[string]interface{}{},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]domainRule{
+		"lenstra.fr":          {AllowBareDomains: boolPtr(true), AllowSubdomains: boolPtr(false)},
+		"internal.lenstra.fr": {},
+	}, rules)
+
+	_, err = parseDomainRules(map[string]interface{}{"lenstra.fr": map[string]interface{}{"allow_foo": true}})
+	require.Error(t, err)
+	_, err = parseDomainRules(map[string]interface{}{"": map[string]interface{}{}})
+	require.EqualError(t, err, "domain_rules cannot contain an empty domain")
+}
+
+func TestRoleDomainRules(t *testing.T) {
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+
+	r := &role{
+		Account:          "lenstra",
+		AllowedDomains:   []string{"*-api.prod.lenstra.fr"},
+		AllowGlobDomains: true,
+		DomainRules: map[string]domainRule{
+			"lenstra.fr":          {AllowBareDomains: boolPtr(true), AllowSubdomains: boolPtr(false)},
+			"internal.lenstra.fr": {AllowWildcardCertificates: boolPtr(true)},
+		},
+		CacheForRatio:       70,
+		KeyType:             "RSA2048",
+		ChallengePreference: []string{},
+	}
+	require.NoError(t, r.save(ctx, storage, "roles/lenstra.fr"))
+	saved, err := getRole(ctx, storage, "roles/lenstra.fr")
+	require.NoError(t, err)
+	require.Equal(t, r, saved)
+	require.True(t, saved.allowsWildcards())
+
+	require.Equal(t, []allowedDomain{
+		{Domain: "*-api.prod.lenstra.fr"},
+		{Domain: "internal.lenstra.fr", AllowWildcardCertificates: true},
+		{Domain: "lenstra.fr", AllowBareDomains: true},
+	}, saved.getAllowedDomains())
+}
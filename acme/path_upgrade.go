@@ -0,0 +1,90 @@
+package acme
+
+import (
+	"context"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func pathUpgrade(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "upgrade",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.upgrade,
+		},
+	}
+}
+
+// upgrade writes back all the accounts, roles and cache entries using an old
+// version of their schema. They are upgraded when read anyway so this is only
+// needed to get rid of the old entries in the storage.
+func (b *backend) upgrade(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	accounts, err := accountSchema.upgrade(ctx, req.Storage, "accounts/")
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to upgrade accounts: {{err}}", err)
+	}
+	if err = moveAccountKeys(ctx, req.Storage); err != nil {
+		return nil, errwrap.Wrapf("failed to move the account keys: {{err}}", err)
+	}
+
+	roles, err := roleSchema.upgrade(ctx, req.Storage, "roles/")
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to upgrade roles: {{err}}", err)
+	}
+
+	b.cache.Lock()
+	defer b.cache.Unlock()
+	cache, err := cacheSchema.upgrade(ctx, req.Storage, cachePrefix)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to upgrade the cache: {{err}}", err)
+	}
+
+	b.Logger().Info("Storage upgraded", "accounts", accounts, "roles", roles, "cache", cache)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"schema_versions": map[string]interface{}{
+				"accounts": accountSchema.version(),
+				"roles":    roleSchema.version(),
+				"cache":    cacheSchema.version(),
+			},
+			"upgraded": map[string]interface{}{
+				"accounts": accounts,
+				"roles":    roles,
+				"cache":    cache,
+			},
+		},
+	}, nil
+}
+
+// moveAccountKeys saves the accounts whose private key is still stored with
+// their settings so it gets moved to its own entry
+func moveAccountKeys(ctx context.Context, storage logical.Storage) error {
+	names, err := storage.List(ctx, "accounts/")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		path := "accounts/" + name
+		d, err := accountSchema.read(ctx, storage, path)
+		if err != nil {
+			return err
+		}
+		if d == nil || d["private_key"] == nil {
+			continue
+		}
+
+		a, err := getAccount(ctx, storage, path)
+		if err != nil {
+			return err
+		}
+		if err = a.save(ctx, storage, path, a.ServerURL); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+package acme
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge"
+	"github.com/go-acme/lego/v3/challenge/dns01"
+	"github.com/go-acme/lego/v3/platform/wait"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/miekg/dns"
+)
+
+const (
+	providerCheckPresent     = "present"
+	providerCheckPropagation = "propagation"
+	providerCheckCleanUp     = "cleanup"
+)
+
+// providerCheckStep is the result of one of the steps of a provider check
+type providerCheckStep struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+func (s providerCheckStep) toMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"name":     s.Name,
+		"success":  s.Err == nil,
+		"duration": s.Duration.String(),
+	}
+	if s.Err != nil {
+		m["error"] = s.Err.Error()
+	}
+	return m
+}
+
+func (b *backend) accountTestProvider(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	path := "accounts/" + data.Get("account").(string)
+	a, err := getAccount(ctx, req.Storage, path)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return logical.ErrorResponse("This account does not exists"), nil
+	}
+
+	domain := data.Get("domain").(string)
+	if domain == "" {
+		return logical.ErrorResponse("domain must be set"), nil
+	}
+
+	provider, err := a.newDNS01Provider(ctx, req.Storage)
+	if err != nil {
+		return logical.ErrorResponse("Failed to create DNS provider: %s", err), nil
+	}
+	if provider == nil {
+		return logical.ErrorResponse("DNS-01 is not enabled on this account"), nil
+	}
+
+	timeout, interval := dns01.DefaultPropagationTimeout, dns01.DefaultPollingInterval
+	if pt, ok := provider.(challenge.ProviderTimeout); ok {
+		timeout, interval = pt.Timeout()
+	}
+	if t, ok := data.GetOk("timeout"); ok {
+		timeout = time.Duration(t.(int)) * time.Second
+	}
+
+	resolvers, err := a.getResolvers()
+	if err != nil {
+		return nil, err
+	}
+
+	// The token is not used by the DNS-01 providers, only the key
+	// authorization ends up in the record
+	random := make([]byte, 32)
+	if _, err = rand.Read(random); err != nil {
+		return nil, err
+	}
+	keyAuth := base64.RawURLEncoding.EncodeToString(random)
+	fqdn, value := dns01.GetRecord(domain, keyAuth)
+
+	steps := testDNSProvider(provider, domain, keyAuth, func() error {
+		return wait.For("TXT record propagation", timeout, interval, func() (bool, error) {
+			err := checkTXTRecord(fqdn, value, resolvers)
+			return err == nil, err
+		})
+	})
+
+	success := true
+	report := make([]map[string]interface{}, len(steps))
+	for i, step := range steps {
+		success = success && step.Err == nil
+		report[i] = step.toMap()
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"success":   success,
+			"domain":    domain,
+			"fqdn":      fqdn,
+			"resolvers": resolvers,
+			"steps":     report,
+		},
+	}, nil
+}
+
+// testDNSProvider creates the TXT record for domain, waits for it to be
+// visible using check and removes it. The record is removed even when check
+// fails.
+func testDNSProvider(provider challenge.Provider, domain, keyAuth string, check func() error) []providerCheckStep {
+	run := func(name string, f func() error) providerCheckStep {
+		start := time.Now()
+		err := f()
+		return providerCheckStep{
+			Name:     name,
+			Duration: time.Since(start),
+			Err:      err,
+		}
+	}
+
+	present := run(providerCheckPresent, func() error {
+		return provider.Present(domain, "", keyAuth)
+	})
+	if present.Err != nil {
+		return []providerCheckStep{present}
+	}
+
+	return []providerCheckStep{
+		present,
+		run(providerCheckPropagation, check),
+		run(providerCheckCleanUp, func() error {
+			return provider.CleanUp(domain, "", keyAuth)
+		}),
+	}
+}
+
+// getResolvers returns the DNS resolvers used to check the propagation of the
+// records, the ones of the system are used when dns_resolvers is not set
+func (a *account) getResolvers() ([]string, error) {
+	if len(a.DNSResolvers) > 0 {
+		return dns01.ParseNameservers(a.DNSResolvers), nil
+	}
+
+	config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the system resolvers: %v", err)
+	}
+	return dns01.ParseNameservers(config.Servers), nil
+}
+
+// checkTXTRecord returns an error unless all the resolvers return value in
+// the TXT records of fqdn
+func checkTXTRecord(fqdn, value string, resolvers []string) error {
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeTXT)
+	m.RecursionDesired = true
+
+	client := &dns.Client{Timeout: 10 * time.Second}
+	for _, resolver := range resolvers {
+		r, _, err := client.Exchange(m, resolver)
+		if err != nil {
+			return fmt.Errorf("failed to query %s: %v", resolver, err)
+		}
+
+		found := false
+		for _, rr := range r.Answer {
+			if txt, ok := rr.(*dns.TXT); ok {
+				for _, v := range txt.Txt {
+					found = found || v == value
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("the TXT record for %s is not visible from %s", fqdn, resolver)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package acme
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// txtServer is a DNS server answering the TXT queries with the records set
+// by a test
+type txtServer struct {
+	sync.Mutex
+	records map[string]string
+}
+
+func (s *txtServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.Lock()
+	defer s.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	for _, q := range r.Question {
+		if value, ok := s.records[q.Name]; ok && q.Qtype == dns.TypeTXT {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{value},
+			})
+		}
+	}
+	_ = w.WriteMsg(m)
+}
+
+func (s *txtServer) Present(domain, token, keyAuth string) error {
+	s.Lock()
+	defer s.Unlock()
+	fqdn, value := getTestRecord(domain, keyAuth)
+	s.records[fqdn] = value
+	return nil
+}
+
+func (s *txtServer) CleanUp(domain, token, keyAuth string) error {
+	s.Lock()
+	defer s.Unlock()
+	fqdn, _ := getTestRecord(domain, keyAuth)
+	delete(s.records, fqdn)
+	return nil
+}
+
+func getTestRecord(domain, keyAuth string) (string, string) {
+	return "_acme-challenge." + domain + ".", keyAuth
+}
+
+func startTXTServer(t *testing.T) (*txtServer, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &txtServer{records: map[string]string{}}
+	server := &dns.Server{PacketConn: conn, Handler: s}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	return s, conn.LocalAddr().String()
+}
+
+func TestCheckTXTRecord(t *testing.T) {
+	s, addr := startTXTServer(t)
+
+	require.EqualError(t, checkTXTRecord("_acme-challenge.lenstra.fr.", "foo", []string{addr}), "the TXT record for _acme-challenge.lenstra.fr. is not visible from "+addr)
+
+	require.NoError(t, s.Present("lenstra.fr", "", "foo"))
+	require.NoError(t, checkTXTRecord("_acme-challenge.lenstra.fr.", "foo", []string{addr}))
+	require.Error(t, checkTXTRecord("_acme-challenge.lenstra.fr.", "bar", []string{addr}))
+}
+
+type failingProvider struct{}
+
+func (failingProvider) Present(domain, token, keyAuth string) error {
+	return errors.New("invalid credentials")
+}
+
+func (failingProvider) CleanUp(domain, token, keyAuth string) error {
+	return nil
+}
+
+func TestTestDNSProvider(t *testing.T) {
+	s, addr := startTXTServer(t)
+
+	steps := testDNSProvider(s, "lenstra.fr", "foo", func() error {
+		return checkTXTRecord("_acme-challenge.lenstra.fr.", "foo", []string{addr})
+	})
+	require.Len(t, steps, 3)
+	for _, step := range steps {
+		require.NoError(t, step.Err, step.Name)
+	}
+	require.Empty(t, s.records)
+
+	// The record is removed even when it cannot be seen
+	steps = testDNSProvider(s, "lenstra.fr", "foo", func() error {
+		return errors.New("not visible")
+	})
+	require.Len(t, steps, 3)
+	require.EqualError(t, steps[1].Err, "not visible")
+	require.NoError(t, steps[2].Err)
+	require.Empty(t, s.records)
+
+	steps = testDNSProvider(failingProvider{}, "lenstra.fr", "foo", nil)
+	require.Equal(t, []map[string]interface{}{
+		{"name": "present", "success": false, "duration": steps[0].Duration.String(), "error": "invalid credentials"},
+	}, []map[string]interface{}{steps[0].toMap()})
+}
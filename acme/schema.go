@@ -0,0 +1,209 @@
+package acme
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// schemaVersionKey is the key holding the version of the schema of the
+// accounts, roles and cache entries. Entries written before it was introduced
+// do not have it and are at version 0.
+const schemaVersionKey = "schema_version"
+
+// migration upgrades a stored entry from one version of its schema to the next
+type migration func(d map[string]interface{}) error
+
+// schema describes the successive layouts of a kind of stored entry. The
+// migration at index i upgrades the entries from version i to version i+1, new
+// migrations must only be appended.
+type schema struct {
+	name       string
+	migrations []migration
+}
+
+var accountSchema = &schema{
+	name: "account",
+	migrations: []migration{
+		// Version 1 sets the defaults of the fields that were added after
+		// the first release so all the fields can be decoded
+		func(d map[string]interface{}) error {
+			setDefault(d, "ignore_dns_propagation", false)
+			setDefault(d, "provider_configuration", map[string]interface{}{})
+			setDefault(d, "dns_zone_providers", map[string]interface{}{})
+			setDefault(d, "dns_resolvers", []interface{}{})
+			setDefault(d, "rate_limit_action", rateLimitActionWarn)
+			return nil
+		},
+		// Version 2 stores the private key in its own entry. Moving it needs
+		// to write to the storage so it is done when the account is saved,
+		// until then it is still read from the account.
+		func(d map[string]interface{}) error {
+			return nil
+		},
+	},
+}
+
+var roleSchema = &schema{
+	name: "role",
+	migrations: []migration{
+		// Version 1 sets the defaults of the fields that were added after
+		// the first release
+		func(d map[string]interface{}) error {
+			setDefault(d, "CacheForRatio", 70)
+			setDefault(d, "AllowedDomains", []interface{}{})
+			return nil
+		},
+		// Version 2 adds the type of the key of the certificates, they were
+		// always generated with RSA2048 before
+		func(d map[string]interface{}) error {
+			setDefault(d, "KeyType", "RSA2048")
+			return nil
+		},
+		// Version 3 adds the glob patterns and the per domain rules
+		func(d map[string]interface{}) error {
+			setDefault(d, "AllowGlobDomains", false)
+			setDefault(d, "DomainRules", map[string]interface{}{})
+			return nil
+		},
+	},
+}
+
+var cacheSchema = &schema{
+	name: "cache",
+	migrations: []migration{
+		// Version 1 only adds the schema version
+		func(d map[string]interface{}) error {
+			return nil
+		},
+	},
+}
+
+// setDefault sets key to value when it is missing or null
+func setDefault(d map[string]interface{}, key string, value interface{}) {
+	if v, ok := d[key]; !ok || v == nil {
+		d[key] = value
+	}
+}
+
+// version returns the current version of the schema
+func (s *schema) version() int {
+	return len(s.migrations)
+}
+
+// migrate upgrades d to the current version of the schema and returns whether
+// it was modified
+func (s *schema) migrate(d map[string]interface{}) (bool, error) {
+	version := 0
+	if v, ok := d[schemaVersionKey]; ok {
+		// The storage decodes the numbers as json.Number
+		n, err := strconv.Atoi(fmt.Sprint(v))
+		if err != nil {
+			return false, fmt.Errorf("invalid schema version %v for %s entry", v, s.name)
+		}
+		version = n
+	}
+
+	if version > s.version() {
+		return false, fmt.Errorf("%s entry has schema version %d but only versions up to %d are supported, it has probably been written by a newer version of the plugin", s.name, version, s.version())
+	}
+
+	for i := version; i < s.version(); i++ {
+		if err := s.migrations[i](d); err != nil {
+			return false, fmt.Errorf("failed to migrate %s entry to version %d: %v", s.name, i+1, err)
+		}
+	}
+	d[schemaVersionKey] = s.version()
+
+	return version != s.version(), nil
+}
+
+// read returns the entry stored at path upgraded to the current version of
+// the schema, or nil if it does not exist. The upgraded entry is not written
+// back as read requests may not be allowed to write to the storage.
+func (s *schema) read(ctx context.Context, storage logical.Storage, path string) (map[string]interface{}, error) {
+	storageEntry, err := storage.Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if storageEntry == nil {
+		return nil, nil
+	}
+
+	var d map[string]interface{}
+	if err = storageEntry.DecodeJSON(&d); err != nil {
+		return nil, err
+	}
+	if _, err = s.migrate(d); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// decode reads the entry stored at path in out, upgrading it to the current
+// version of the schema first. It returns false if the entry does not exist.
+func (s *schema) decode(ctx context.Context, storage logical.Storage, path string, out interface{}) (bool, error) {
+	d, err := s.read(ctx, storage, path)
+	if err != nil || d == nil {
+		return false, err
+	}
+
+	// Going through JSON again gives typed errors instead of panics when a
+	// field does not have the expected type
+	b, err := json.Marshal(d)
+	if err != nil {
+		return false, err
+	}
+	if err = json.Unmarshal(b, out); err != nil {
+		return false, fmt.Errorf("failed to decode %s entry %q: %v", s.name, path, err)
+	}
+
+	return true, nil
+}
+
+// upgrade writes back the entries under prefix that do not use the current
+// version of the schema and returns how many were upgraded
+func (s *schema) upgrade(ctx context.Context, storage logical.Storage, prefix string) (int, error) {
+	keys, err := storage.List(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	var upgraded int
+	for _, key := range keys {
+		storageEntry, err := storage.Get(ctx, prefix+key)
+		if err != nil {
+			return upgraded, err
+		}
+		if storageEntry == nil {
+			continue
+		}
+
+		var d map[string]interface{}
+		if err = storageEntry.DecodeJSON(&d); err != nil {
+			return upgraded, err
+		}
+		changed, err := s.migrate(d)
+		if err != nil {
+			return upgraded, fmt.Errorf("failed to upgrade %q: %v", prefix+key, err)
+		}
+		if !changed {
+			continue
+		}
+
+		storageEntry, err = logical.StorageEntryJSON(prefix+key, d)
+		if err != nil {
+			return upgraded, err
+		}
+		if err = storage.Put(ctx, storageEntry); err != nil {
+			return upgraded, err
+		}
+		upgraded++
+	}
+
+	return upgraded, nil
+}
@@ -0,0 +1,150 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func putRawEntry(t *testing.T, storage logical.Storage, path string, d map[string]interface{}) {
+	storageEntry, err := logical.StorageEntryJSON(path, d)
+	require.NoError(t, err)
+	require.NoError(t, storage.Put(context.Background(), storageEntry))
+}
+
+// getOldAccountEntry returns an account as it was stored by the first release
+func getOldAccountEntry(t *testing.T) map[string]interface{} {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	return map[string]interface{}{
+		"server_url":              "https://localhost:14000/dir",
+		"registration_uri":        "https://localhost:14000/my-account/1",
+		"contact":                 "remi@lenstra.fr",
+		"terms_of_service_agreed": true,
+		"private_key":             string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"key_type":                "EC256",
+		"provider":                "exec",
+		"provider_configuration":  nil,
+		"enable_http_01":          false,
+		"enable_tls_alpn_01":      false,
+		"dns_resolvers":           nil,
+	}
+}
+
+func TestSchemaMigrate(t *testing.T) {
+	d := getOldAccountEntry(t)
+	changed, err := accountSchema.migrate(d)
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, accountSchema.version(), d[schemaVersionKey])
+	require.Equal(t, []interface{}{}, d["dns_resolvers"])
+	require.Equal(t, rateLimitActionWarn, d["rate_limit_action"])
+
+	changed, err = accountSchema.migrate(d)
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	d[schemaVersionKey] = json.Number("42")
+	_, err = accountSchema.migrate(d)
+	require.EqualError(t, err, "account entry has schema version 42 but only versions up to 2 are supported, it has probably been written by a newer version of the plugin")
+}
+
+func TestGetOldAccount(t *testing.T) {
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+
+	putRawEntry(t, storage, "accounts/lenstra", getOldAccountEntry(t))
+	a, err := getAccount(ctx, storage, "accounts/lenstra")
+	require.NoError(t, err)
+	require.Equal(t, "remi@lenstra.fr", a.Email)
+	require.Equal(t, "https://localhost:14000/my-account/1", a.Registration.URI)
+	require.Equal(t, []string{}, a.DNSResolvers)
+	require.Equal(t, map[string]string{}, a.ProviderConfiguration)
+	require.Equal(t, map[string]string{}, a.DNSZoneProviders)
+	require.Equal(t, rateLimitActionWarn, a.RateLimitAction)
+	require.False(t, a.IgnoreDNSPropagation)
+
+	// A field with the wrong type must not make the plugin panic
+	d := getOldAccountEntry(t)
+	d["dns_resolvers"] = "127.0.0.1"
+	putRawEntry(t, storage, "accounts/lenstra", d)
+	_, err = getAccount(ctx, storage, "accounts/lenstra")
+	require.Error(t, err)
+}
+
+func TestUpgrade(t *testing.T) {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b, err := Factory(context.Background(), config)
+	require.NoError(t, err)
+
+	putRawEntry(t, config.StorageView, "accounts/lenstra", getOldAccountEntry(t))
+	putRawEntry(t, config.StorageView, "roles/lenstra.fr", map[string]interface{}{
+		"Account":          "lenstra",
+		"AllowedDomains":   nil,
+		"AllowBareDomains": true,
+		"AllowSubdomains":  false,
+		"DisableCache":     false,
+		"CacheForRatio":    50,
+	})
+	putRawEntry(t, config.StorageView, cachePrefix+"foo", map[string]interface{}{
+		"Users":   1,
+		"Account": "lenstra",
+	})
+
+	r, err := getRole(context.Background(), config.StorageView, "roles/lenstra.fr")
+	require.NoError(t, err)
+	require.Equal(t, 50, r.CacheForRatio)
+	require.Equal(t, []string{}, r.AllowedDomains)
+	require.Equal(t, "RSA2048", r.KeyType)
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "upgrade",
+		Storage:   config.StorageView,
+	}
+	resp := makeRequest(t, b, req, "")
+	require.Equal(t, map[string]interface{}{"accounts": 1, "roles": 1, "cache": 1}, resp.Data["upgraded"])
+
+	versions := map[string]int{
+		"accounts/lenstra":  accountSchema.version(),
+		"roles/lenstra.fr":  roleSchema.version(),
+		cachePrefix + "foo": cacheSchema.version(),
+	}
+	for path, version := range versions {
+		storageEntry, err := config.StorageView.Get(context.Background(), path)
+		require.NoError(t, err)
+		var d map[string]interface{}
+		require.NoError(t, storageEntry.DecodeJSON(&d))
+		require.Equal(t, json.Number(strconv.Itoa(version)), d[schemaVersionKey], path)
+		require.NotContains(t, d, "private_key", path)
+	}
+
+	// The private key of the account has been moved to its own entry
+	keyEntry, err := config.StorageView.Get(context.Background(), "account_keys/lenstra")
+	require.NoError(t, err)
+	require.NotNil(t, keyEntry)
+	a, err := getAccount(context.Background(), config.StorageView, "accounts/lenstra")
+	require.NoError(t, err)
+	require.NotNil(t, a.Key)
+
+	// The role is still the same
+	upgraded, err := getRole(context.Background(), config.StorageView, "roles/lenstra.fr")
+	require.NoError(t, err)
+	require.Equal(t, r, upgraded)
+
+	resp = makeRequest(t, b, req, "")
+	require.Equal(t, map[string]interface{}{"accounts": 0, "roles": 0, "cache": 0}, resp.Data["upgraded"])
+}
@@ -58,18 +58,24 @@ func (b *backend) certRevoke(ctx context.Context, req *logical.Request, data *fr
 		return nil, err
 	}
 
-	ce.Users--
-	if ce.Users > 0 {
+	// The entry is missing when the cache is disabled for the role or when it
+	// has been cleared, the certificate is then only used by this lease
+	if ce != nil {
+		ce.Users--
+	}
+	if ce != nil && ce.Users > 0 {
 		err = ce.Save(ctx, req.Storage, cacheKey)
 		if err != nil {
 			return nil, err
 		}
 	} else {
 		// If the last user asked for the lease to be terminated we revoke the cert
-		b.Logger().Debug("Removing cached cert", "key", cacheKey)
-		err = b.cache.Delete(ctx, req.Storage, cacheKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to remove cache entry: %v", err)
+		if ce != nil {
+			b.Logger().Debug("Removing cached cert", "key", cacheKey)
+			err = b.cache.Delete(ctx, req.Storage, cacheKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to remove cache entry: %v", err)
+			}
 		}
 
 		accountPath := req.Secret.InternalData["account"].(string)
@@ -80,6 +86,13 @@ func (b *backend) certRevoke(ctx context.Context, req *logical.Request, data *fr
 		if a == nil {
 			return nil, fmt.Errorf("error while revoking certificate: user not found")
 		}
+		// The account is not registered anymore with the CA that issued the
+		// certificate after a migration so it cannot revoke it. The leases
+		// created before server_url was recorded are revoked as before.
+		if serverURL, ok := req.Secret.InternalData["server_url"].(string); ok && serverURL != a.ServerURL {
+			b.Logger().Warn("Not revoking a certificate issued before the account was migrated", "account", accountPath, "server_url", serverURL)
+			return nil, nil
+		}
 		client, err := a.getClient()
 		if err != nil {
 			return logical.ErrorResponse("Failed to get LEGO client."), err
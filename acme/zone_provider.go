@@ -0,0 +1,140 @@
+package acme
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge"
+	"github.com/go-acme/lego/v3/challenge/dns01"
+)
+
+// zoneProvider is a DNS-01 provider that sends each challenge to the provider
+// configured for the longest DNS zone matching the domain
+type zoneProvider struct {
+	zones    map[string]challenge.Provider
+	fallback challenge.Provider
+}
+
+// sequentialProvider is implemented by the DNS providers that must solve the
+// challenges one at a time. lego only checks whether the method exists so a
+// wrapper must not expose it when none of the providers it wraps do.
+type sequentialProvider interface {
+	Sequential() time.Duration
+}
+
+// sequentialZoneProvider is a zoneProvider wrapping at least one sequential
+// provider
+type sequentialZoneProvider struct {
+	*zoneProvider
+	interval time.Duration
+}
+
+// Sequential returns the largest interval of the sequential providers
+func (p *sequentialZoneProvider) Sequential() time.Duration {
+	return p.interval
+}
+
+func newZoneProvider(zones map[string]challenge.Provider, fallback challenge.Provider) challenge.Provider {
+	normalized := make(map[string]challenge.Provider, len(zones))
+	for zone, provider := range zones {
+		normalized[normalizeZone(zone)] = provider
+	}
+
+	p := &zoneProvider{
+		zones:    normalized,
+		fallback: fallback,
+	}
+
+	sequential := false
+	var interval time.Duration
+	for _, provider := range p.providers() {
+		if sp, ok := provider.(sequentialProvider); ok {
+			sequential = true
+			if i := sp.Sequential(); i > interval {
+				interval = i
+			}
+		}
+	}
+	if sequential {
+		return &sequentialZoneProvider{zoneProvider: p, interval: interval}
+	}
+
+	return p
+}
+
+// providers returns all the providers used by p
+func (p *zoneProvider) providers() []challenge.Provider {
+	var providers []challenge.Provider
+	if p.fallback != nil {
+		providers = append(providers, p.fallback)
+	}
+	for _, provider := range p.zones {
+		providers = append(providers, provider)
+	}
+	return providers
+}
+
+func normalizeZone(zone string) string {
+	return strings.ToLower(strings.TrimSuffix(zone, "."))
+}
+
+// getProvider returns the provider to use for domain
+func (p *zoneProvider) getProvider(domain string) (challenge.Provider, error) {
+	domain = normalizeZone(domain)
+
+	var match string
+	var provider challenge.Provider
+	for zone, zp := range p.zones {
+		if domain != zone && !strings.HasSuffix(domain, "."+zone) {
+			continue
+		}
+		if len(zone) > len(match) {
+			match = zone
+			provider = zp
+		}
+	}
+
+	if provider != nil {
+		return provider, nil
+	}
+	if p.fallback != nil {
+		return p.fallback, nil
+	}
+	return nil, fmt.Errorf("no DNS provider configured for %q", domain)
+}
+
+func (p *zoneProvider) Present(domain, token, keyAuth string) error {
+	provider, err := p.getProvider(domain)
+	if err != nil {
+		return err
+	}
+	return provider.Present(domain, token, keyAuth)
+}
+
+func (p *zoneProvider) CleanUp(domain, token, keyAuth string) error {
+	provider, err := p.getProvider(domain)
+	if err != nil {
+		return err
+	}
+	return provider.CleanUp(domain, token, keyAuth)
+}
+
+// Timeout returns the largest timeout and interval of the providers so we
+// wait long enough whichever one is used
+func (p *zoneProvider) Timeout() (timeout, interval time.Duration) {
+	for _, provider := range p.providers() {
+		t, i := dns01.DefaultPropagationTimeout, dns01.DefaultPollingInterval
+		if pt, ok := provider.(challenge.ProviderTimeout); ok {
+			t, i = pt.Timeout()
+		}
+		if t > timeout {
+			timeout = t
+		}
+		if i > interval {
+			interval = i
+		}
+	}
+
+	return timeout, interval
+}
@@ -0,0 +1,100 @@
+package acme
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge"
+	"github.com/go-acme/lego/v3/providers/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingProvider struct {
+	name    string
+	domains *[]string
+	timeout time.Duration
+}
+
+func (p recordingProvider) Present(domain, token, keyAuth string) error {
+	*p.domains = append(*p.domains, p.name+":"+domain)
+	return nil
+}
+
+func (p recordingProvider) CleanUp(domain, token, keyAuth string) error {
+	return nil
+}
+
+func (p recordingProvider) Timeout() (time.Duration, time.Duration) {
+	return p.timeout, time.Second
+}
+
+type sequentialRecordingProvider struct {
+	recordingProvider
+	interval time.Duration
+}
+
+func (p sequentialRecordingProvider) Sequential() time.Duration {
+	return p.interval
+}
+
+func TestZoneProvider(t *testing.T) {
+	var domains []string
+	zones := map[string]challenge.Provider{
+		"lenstra.fr":           recordingProvider{"route53", &domains, time.Minute},
+		"internal.lenstra.fr.": recordingProvider{"rfc2136", &domains, 5 * time.Minute},
+		"example.com":          recordingProvider{"cloudflare", &domains, time.Minute},
+	}
+
+	p := newZoneProvider(zones, nil)
+	for _, domain := range []string{"lenstra.fr", "www.lenstra.fr", "db.internal.lenstra.fr", "WWW.Example.com"} {
+		require.NoError(t, p.Present(domain, "", ""))
+	}
+	require.Equal(t, []string{
+		"route53:lenstra.fr",
+		"route53:www.lenstra.fr",
+		"rfc2136:db.internal.lenstra.fr",
+		"cloudflare:WWW.Example.com",
+	}, domains)
+
+	require.EqualError(t, p.Present("notlenstra.fr", "", ""), `no DNS provider configured for "notlenstra.fr"`)
+
+	p = newZoneProvider(zones, recordingProvider{"default", &domains, time.Minute})
+	require.NoError(t, p.Present("notlenstra.fr", "", ""))
+	require.Equal(t, "default:notlenstra.fr", domains[len(domains)-1])
+
+	timeout, interval := p.(challenge.ProviderTimeout).Timeout()
+	require.Equal(t, 5*time.Minute, timeout)
+	require.Equal(t, time.Second, interval)
+
+	// None of the providers must solve the challenges one at a time
+	_, ok := p.(sequentialProvider)
+	require.False(t, ok)
+}
+
+func TestZoneProviderSequential(t *testing.T) {
+	var domains []string
+	exec, err := dns.NewDNSChallengeProviderByName("exec", map[string]string{
+		"EXEC_PATH":                "/dev/null",
+		"EXEC_PROPAGATION_TIMEOUT": "90",
+	})
+	require.NoError(t, err)
+
+	zones := map[string]challenge.Provider{
+		"lenstra.fr":          recordingProvider{"route53", &domains, time.Minute},
+		"internal.lenstra.fr": exec,
+	}
+	p := newZoneProvider(zones, nil)
+	sp, ok := p.(sequentialProvider)
+	require.True(t, ok)
+	require.Equal(t, 90*time.Second, sp.Sequential())
+
+	// The largest interval is used when several providers are sequential
+	p = newZoneProvider(zones, sequentialRecordingProvider{recordingProvider{"rfc2136", &domains, time.Minute}, 5 * time.Minute})
+	sp, ok = p.(sequentialProvider)
+	require.True(t, ok)
+	require.Equal(t, 5*time.Minute, sp.Sequential())
+
+	require.NoError(t, p.Present("www.lenstra.fr", "", ""))
+	require.NoError(t, p.Present("notlenstra.fr", "", ""))
+	require.Equal(t, []string{"route53:www.lenstra.fr", "rfc2136:notlenstra.fr"}, domains)
+}
@@ -14,12 +14,16 @@ require (
 	github.com/hashicorp/go-version v1.2.0 // indirect
 	github.com/hashicorp/vault/api v1.0.5-0.20190909201928-35325e2c3262
 	github.com/hashicorp/vault/sdk v0.1.14-0.20190909201848-e0fbf9b652e2
+	github.com/miekg/dns v1.1.27
 	github.com/mitchellh/mapstructure v1.3.1
 	github.com/pierrec/lz4 v2.2.6+incompatible // indirect
 	github.com/remilapeyre/vault-acme/acme/sidecar v0.0.0
+	github.com/ryanuber/go-glob v1.0.0
 	github.com/stretchr/objx v0.2.0 // indirect
 	github.com/stretchr/testify v1.6.1
+	golang.org/x/net v0.0.0-20200301022130-244492dfa37a
 	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad // indirect
+	gopkg.in/square/go-jose.v2 v2.3.1
 )
 
 replace github.com/remilapeyre/vault-acme/acme/sidecar v0.0.0 => ./acme/sidecar